@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AlertConfig of the alerts on the masked ratios found by the health checks,
+// a threshold not above 0 disables the alerts of its scope
+type AlertConfig struct {
+	// urls the alerts are posted to, no alert is sent when empty
+	Webhooks []string
+	// key of the hmac-sha256 signature of the alerts, not signed when empty
+	Secret string
+	// masked ratio of the idcs covering a province, or an area, for an isp
+	CoverageThreshold float64
+	// masked ratio of the provinces and isps covered by an idc
+	IdcThreshold float64
+	// masked ratio of all the covering idcs
+	GlobalThreshold float64
+	Timeout         time.Duration
+}
+
+func (conf *AlertConfig) validate() error {
+	for _, threshold := range []float64{conf.CoverageThreshold, conf.IdcThreshold, conf.GlobalThreshold} {
+		if threshold > 1 {
+			return fmt.Errorf("threshold %v is above 1", threshold)
+		}
+	}
+	for _, url := range conf.Webhooks {
+		if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+			return fmt.Errorf("webhook %s is not a http url", url)
+		}
+	}
+	return nil
+}
+
+// the scopes of the alerts
+const (
+	alertScopeCoverage = "coverage"
+	alertScopeIdc      = "idc"
+	alertScopeGlobal   = "global"
+)
+
+// the event of the alerts posted to the webhooks
+const eventAlert = "alert"
+
+// alert is posted as the data of an event to the webhooks when it fires and
+// when it resolves
+type alert struct {
+	// firing or resolved
+	Status string `json:"status"`
+	Scope  string `json:"scope"`
+	// identity of the alert in its scope, for the receivers to dedupe
+	Key string `json:"key"`
+	// the names of the coverage or the idc
+	Labels    map[string]string `json:"labels,omitempty"`
+	Ratio     float64           `json:"ratio"`
+	Threshold float64           `json:"threshold"`
+	VersionId int64             `json:"version_id"`
+	StartsAt  time.Time         `json:"starts_at"`
+	EndsAt    *time.Time        `json:"ends_at,omitempty"`
+}
+
+// alerter keeps the alerts firing, so an alert is sent once when it fires and
+// once when it resolves. The state is not shared, a new leader sends again
+// the alerts still firing.
+type alerter struct {
+	conf *AlertConfig
+	// delivers the alerts in the background with the retries of retry, it
+	// runs until the server stops
+	webhooks *webhookDispatcher
+	now      func() time.Time
+
+	mu     sync.Mutex
+	firing map[string]*alert
+}
+
+func newAlerter(conf *AlertConfig, retry *WebhookConfig) *alerter {
+	webhookConf := &WebhookConfig{
+		Timeout:        conf.Timeout,
+		Retries:        retry.Retries,
+		InitialBackoff: retry.InitialBackoff,
+		LogSize:        retry.LogSize,
+	}
+	for _, url := range conf.Webhooks {
+		webhookConf.Subscribers = append(webhookConf.Subscribers, WebhookSubscriber{Name: url, Url: url, Secret: conf.Secret})
+	}
+	return &alerter{
+		conf:     conf,
+		webhooks: newWebhookDispatcher(webhookConf),
+		now:      time.Now,
+		firing:   make(map[string]*alert),
+	}
+}
+
+func coverageAlertKey(coverage *coverageHealth) string {
+	return strings.Join([]string{coverage.Nation, coverage.Province, coverage.Area, coverage.Isp}, "/")
+}
+
+// the alerts over their thresholds in report, by scope and key
+func (a *alerter) overThreshold(report *healthReport) map[string]*alert {
+	result := make(map[string]*alert)
+	add := func(scope, key string, labels map[string]string, ratio, threshold float64) {
+		if threshold > 0 && ratio >= threshold {
+			result[scope+":"+key] = &alert{Scope: scope, Key: key, Labels: labels, Ratio: ratio, Threshold: threshold, VersionId: report.VersionId}
+		}
+	}
+	for _, coverage := range report.Coverages {
+		labels := map[string]string{"nation": coverage.Nation, "province": coverage.Province, "isp": coverage.Isp}
+		if coverage.Area != "" {
+			labels["area"] = coverage.Area
+		}
+		add(alertScopeCoverage, coverageAlertKey(&coverage), labels, coverage.Impaired, a.conf.CoverageThreshold)
+	}
+	for _, idc := range report.IdcHealth {
+		add(alertScopeIdc, idc.Idc, map[string]string{"idc": idc.Idc}, idc.Impaired, a.conf.IdcThreshold)
+	}
+	add(alertScopeGlobal, "all", nil, report.Impaired, a.conf.GlobalThreshold)
+	return result
+}
+
+// fire the new alerts over their thresholds and resolve those recovered
+func (a *alerter) evaluate(report *healthReport) {
+	a.mu.Lock()
+	now := a.now()
+	var notifications []alert
+	current := a.overThreshold(report)
+	for id, over := range current {
+		if firing, ok := a.firing[id]; ok {
+			// already sent, only the ratio is followed
+			firing.Ratio, firing.VersionId = over.Ratio, over.VersionId
+			continue
+		}
+		over.Status, over.StartsAt = "firing", now
+		a.firing[id] = over
+		notifications = append(notifications, *over)
+	}
+	for id, firing := range a.firing {
+		if _, ok := current[id]; ok {
+			continue
+		}
+		resolved := *firing
+		resolved.Status, resolved.EndsAt = "resolved", &now
+		if over := a.findRatio(report, firing); over >= 0 {
+			resolved.Ratio = over
+		}
+		resolved.VersionId = report.VersionId
+		delete(a.firing, id)
+		notifications = append(notifications, resolved)
+	}
+	a.mu.Unlock()
+
+	sortAlerts(notifications)
+	for i := range notifications {
+		a.webhooks.emit(eventAlert, &notifications[i])
+	}
+}
+
+// the ratio of the scope and key of an alert in report, -1 when it is gone
+func (a *alerter) findRatio(report *healthReport, firing *alert) float64 {
+	switch firing.Scope {
+	case alertScopeCoverage:
+		for _, coverage := range report.Coverages {
+			if coverageAlertKey(&coverage) == firing.Key {
+				return coverage.Impaired
+			}
+		}
+	case alertScopeIdc:
+		for _, idc := range report.IdcHealth {
+			if idc.Idc == firing.Key {
+				return idc.Impaired
+			}
+		}
+	case alertScopeGlobal:
+		return report.Impaired
+	}
+	return -1
+}
+
+func (a *alerter) firingAlerts() []alert {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alerts := make([]alert, 0, len(a.firing))
+	for _, firing := range a.firing {
+		alerts = append(alerts, *firing)
+	}
+	sortAlerts(alerts)
+	return alerts
+}
+
+func sortAlerts(alerts []alert) {
+	sort.Slice(alerts, func(i, j int) bool {
+		if alerts[i].Scope != alerts[j].Scope {
+			return alerts[i].Scope < alerts[j].Scope
+		}
+		if alerts[i].Key != alerts[j].Key {
+			return alerts[i].Key < alerts[j].Key
+		}
+		return alerts[i].Status < alerts[j].Status
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// the status and key of the alerts received
+func receivedAlerts(t *testing.T, events []receivedEvent) []string {
+	t.Helper()
+	var result []string
+	for _, event := range events {
+		var received alert
+		if err := json.Unmarshal(event.Data, &received); err != nil || event.Event != eventAlert {
+			t.Errorf("unexpected alert %+v: %v", event, err)
+		}
+		result = append(result, received.Status+" "+received.Scope+":"+received.Key)
+	}
+	return result
+}
+
+var testAlertRetry = &WebhookConfig{Retries: 2, InitialBackoff: time.Millisecond, LogSize: 10}
+
+func TestAlerterFireAndResolve(t *testing.T) {
+	// the first alert is retried
+	receiver := newWebhookReceiver(t, "s3cret", 1)
+	a := newAlerter(&AlertConfig{
+		Webhooks:          []string{receiver.URL},
+		Secret:            "s3cret",
+		CoverageThreshold: 1,
+		IdcThreshold:      0.9,
+		GlobalThreshold:   0.3,
+		Timeout:           time.Second,
+	}, testAlertRetry)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go a.webhooks.run(ctx)
+	down := &healthReport{
+		VersionId: 1,
+		Impaired:  0.4,
+		Coverages: []coverageHealth{
+			{Nation: "china", Province: "beijing", Isp: "telecom", Idcs: 1, MaskedIdcs: []string{"bj-idc-1"}, Impaired: 1},
+			{Nation: "china", Province: "beijing", Isp: "mobile", Idcs: 2, MaskedIdcs: []string{"bj-idc-1"}, HealthyIdcs: 1, Impaired: 0.5},
+		},
+		IdcHealth: []idcHealth{{Idc: "bj-idc-1", Coverages: 3, MaskedCoverages: 2, Impaired: 2.0 / 3}},
+	}
+	a.evaluate(down)
+	want := []string{"firing coverage:china/beijing//telecom", "firing global:all"}
+	if got := receivedAlerts(t, receiver.wait(t, 2)); !reflect.DeepEqual(got, want) {
+		t.Errorf("got alerts %v, want %v", got, want)
+	}
+	if firing := a.firingAlerts(); len(firing) != 2 {
+		t.Errorf("got %d alerts firing, want 2", len(firing))
+	}
+
+	// sent once while firing, an alert sent again would come before the
+	// resolved ones
+	a.evaluate(down)
+
+	recovered := &healthReport{
+		VersionId: 2,
+		Coverages: []coverageHealth{
+			{Nation: "china", Province: "beijing", Isp: "telecom", Idcs: 1, HealthyIdcs: 1},
+		},
+	}
+	a.evaluate(recovered)
+	want = []string{"resolved coverage:china/beijing//telecom", "resolved global:all"}
+	if got := receivedAlerts(t, receiver.wait(t, 4)[2:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("got alerts %v, want %v", got, want)
+	}
+	if firing := a.firingAlerts(); len(firing) != 0 {
+		t.Errorf("got alerts %+v still firing", firing)
+	}
+}
+
+func TestCheckHealthAlerts(t *testing.T) {
+	receiver := newWebhookReceiver(t, "", 0)
+	conf := testConfig()
+	conf.Alert = AlertConfig{Webhooks: []string{receiver.URL}, IdcThreshold: 0.5, Timeout: time.Second}
+	conf.Webhooks = *testAlertRetry
+	s, _, mock := startTestServer(t, conf)
+
+	// bj-idc-1 covers 3 of the 4 provinces and isps, 2 of them are masked
+	mock.ExpectQuery(getLinkMasksSql).
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask"}).
+			AddRow(156, 11, 1, 1001, 1).
+			AddRow(156, 12, 1, 1001, 1))
+	if err := s.checkHealth(); err != nil {
+		t.Fatalf("check health failed: %v", err)
+	}
+	if got, want := receivedAlerts(t, receiver.wait(t, 1)), []string{"firing idc:bj-idc-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got alerts %v, want %v", got, want)
+	}
+
+	mock.ExpectQuery(getLinkMasksSql).
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask"}))
+	if err := s.checkHealth(); err != nil {
+		t.Fatalf("check health failed: %v", err)
+	}
+	if got, want := receivedAlerts(t, receiver.wait(t, 2)[1:]), []string{"resolved idc:bj-idc-1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got alerts %v, want %v", got, want)
+	}
+}
+
+func TestAlertsDoNotBlockStop(t *testing.T) {
+	// the receiver answers nothing until the request is canceled
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the cancel is only seen once the body is read
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+	}))
+	t.Cleanup(receiver.Close)
+	conf := testConfig()
+	conf.Alert = AlertConfig{Webhooks: []string{receiver.URL}, IdcThreshold: 0.5, Timeout: time.Minute}
+	conf.Webhooks = *testAlertRetry
+	var checked time.Time
+	// run after the server is stopped
+	t.Cleanup(func() {
+		if elapsed := time.Since(checked); elapsed > 5*time.Second {
+			t.Errorf("stop took %v with an alert in flight", elapsed)
+		}
+	})
+	s, _, mock := startTestServer(t, conf)
+
+	mock.ExpectQuery(getLinkMasksSql).
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask"}).
+			AddRow(156, 11, 1, 1001, 1).
+			AddRow(156, 12, 1, 1001, 1))
+	start := time.Now()
+	if err := s.checkHealth(); err != nil {
+		t.Fatalf("check health failed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("check health took %v with an alert in flight", elapsed)
+	}
+	checked = time.Now()
+}
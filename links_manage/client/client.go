@@ -0,0 +1,364 @@
+// Package client is the Go client of the links_manage server for the probe
+// agents: it queries the links to probe, watches them for changes and posts
+// the exception masks found.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Link is a link to probe, the names are those of the dictionaries of the
+// server
+type Link struct {
+	Nation   string `json:"nation"`
+	Province string `json:"province"`
+	// empty for a link of the whole province
+	City string `json:"city,omitempty"`
+	// set for a link of an area kept as a whole, the province is empty then
+	Area     string  `json:"area,omitempty"`
+	Isp      string  `json:"isp"`
+	Idc      string  `json:"idc_name"`
+	Priority int64   `json:"priority"`
+	Weight   float64 `json:"weight"`
+	// only with LinkQuery.Ips
+	Ips []LinkIp `json:"ips,omitempty"`
+}
+
+// LinkIp is an enabled ip of the idc of a link
+type LinkIp struct {
+	Ip    string `json:"ip"`
+	Vip   string `json:"vip"`
+	Type  int64  `json:"type"`
+	Inner bool   `json:"inner"`
+}
+
+// LinkSet is the links of a version
+type LinkSet struct {
+	VersionId int64  `json:"version_id"`
+	Links     []Link `json:"links"`
+}
+
+// Mask is the exception mask of a link, 0 restores the link. The masks are
+// set for the whole province, City and Area are ignored.
+type Mask struct {
+	Nation        string `json:"nation"`
+	Province      string `json:"province"`
+	Isp           string `json:"isp"`
+	Idc           string `json:"idc_name"`
+	ExceptionMask int64  `json:"exception_mask"`
+}
+
+// MaskRecord is a mask set on the server, with who set it and when
+type MaskRecord struct {
+	Mask
+	// the client certificate identity, or the ip without mtls
+	UpdatedBy  string    `json:"updated_by"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+// MaskSet is the masks set on the server
+type MaskSet struct {
+	Masks []MaskRecord `json:"masks"`
+	// number of the masks of links without names in the dictionaries of the
+	// server, they are not in Masks
+	Untranslated int `json:"untranslated"`
+}
+
+// PostResult tells the masks written by PostMasks
+type PostResult struct {
+	Accepted int
+	// the masks of names the server does not know, they are dropped
+	Rejected []Mask
+}
+
+// LinkQuery selects the links and the details returned, the zero value asks
+// for all the links with their priority and weight
+type LinkQuery struct {
+	// city or province, the links of the cities are merged into their
+	// province with province
+	Granularity string
+	// the ips to probe, of the type IpType when not nil and of the scope
+	// IpScope, inner or outer, when not empty
+	Ips     bool
+	IpType  *int64
+	IpScope string
+}
+
+func (q *LinkQuery) values() url.Values {
+	values := url.Values{"weights": {"1"}}
+	if q == nil {
+		return values
+	}
+	if q.Granularity != "" {
+		values.Set("granularity", q.Granularity)
+	}
+	if q.Ips {
+		values.Set("ips", "1")
+	}
+	if q.IpType != nil {
+		values.Set("ip_type", strconv.FormatInt(*q.IpType, 10))
+	}
+	if q.IpScope != "" {
+		values.Set("ip_scope", q.IpScope)
+	}
+	return values
+}
+
+// APIError is a response of the server with a non zero errno, it is not
+// retried
+type APIError struct {
+	Errno   int64
+	Message string
+}
+
+func (err *APIError) Error() string {
+	return fmt.Sprintf("errno %d: %s", err.Errno, err.Message)
+}
+
+// BatchError is returned by PostMasks when a batch failed, the batches before
+// it are posted
+type BatchError struct {
+	// number of masks posted before the failed batch
+	Posted int
+	Err    error
+}
+
+func (err *BatchError) Error() string {
+	return fmt.Sprintf("post masks failed after %d posted: %s", err.Posted, err.Err.Error())
+}
+
+// Client of a server, safe for concurrent use
+type Client struct {
+	baseUrl    string
+	httpClient *http.Client
+	// retries of a failed request, the delay doubles from backoff
+	retries int
+	backoff time.Duration
+	// masks posted by a request
+	batchSize int
+	// the errors Watch goes on after
+	onError func(err error)
+}
+
+// Option of New
+type Option func(c *Client)
+
+// WithHTTPClient sends the requests with httpClient, for tls for example
+func WithHTTPClient(httpClient *http.Client) Option {
+	return func(c *Client) { c.httpClient = httpClient }
+}
+
+// WithRetries retries a request failed by the network or a 5xx status
+// retries times, waiting backoff before the first retry and twice as long
+// before every next one
+func WithRetries(retries int, backoff time.Duration) Option {
+	return func(c *Client) { c.retries, c.backoff = retries, backoff }
+}
+
+// WithBatchSize posts the masks by batches of size
+func WithBatchSize(size int) Option {
+	return func(c *Client) { c.batchSize = size }
+}
+
+// WithErrorHandler is told the errors Watch goes on after
+func WithErrorHandler(onError func(err error)) Option {
+	return func(c *Client) { c.onError = onError }
+}
+
+// New client of the server at baseUrl, http://host:port
+func New(baseUrl string, opts ...Option) *Client {
+	c := &Client{
+		baseUrl:    strings.TrimRight(baseUrl, "/"),
+		httpClient: &http.Client{Timeout: 10 * time.Second},
+		retries:    3,
+		backoff:    500 * time.Millisecond,
+		batchSize:  100,
+		onError:    func(err error) {},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.batchSize <= 0 {
+		c.batchSize = 1
+	}
+	return c
+}
+
+// the errno and error of all the responses
+type apiStatus struct {
+	Errno int64  `json:"errno"`
+	Error string `json:"error"`
+}
+
+// send the request until it is answered, and decode the response into out
+func (c *Client) do(ctx context.Context, method, path string, body []byte, out interface{}) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		content, err := c.send(ctx, method, path, body)
+		if err == nil {
+			var status apiStatus
+			if err = json.Unmarshal(content, &status); err != nil {
+				return fmt.Errorf("decode response of %s failed: %s", path, err.Error())
+			}
+			if status.Errno != 0 {
+				return &APIError{Errno: status.Errno, Message: status.Error}
+			}
+			if out == nil {
+				return nil
+			}
+			return json.Unmarshal(content, out)
+		}
+		// the request itself is refused
+		if status, ok := err.(errorStatus); ok && status < http.StatusInternalServerError {
+			return err
+		}
+		if attempt >= c.retries || ctx.Err() != nil {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// errorStatus is a http status which is not 200
+type errorStatus int
+
+func (status errorStatus) Error() string {
+	return fmt.Sprintf("http status %d", int(status))
+}
+
+func (c *Client) send(ctx context.Context, method, path string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, c.baseUrl+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errorStatus(resp.StatusCode)
+	}
+	return content, nil
+}
+
+// Changed tells whether the version of the links is not versionId, with the
+// current version. A client without links yet uses 0.
+func (c *Client) Changed(ctx context.Context, versionId int64) (bool, int64, error) {
+	var resp struct {
+		IsChanged bool  `json:"is_changed"`
+		VersionId int64 `json:"version_id"`
+	}
+	path := "/is_detect_link_changed?version_id=" + strconv.FormatInt(versionId, 10)
+	if err := c.do(ctx, http.MethodGet, path, nil, &resp); err != nil {
+		return false, 0, err
+	}
+	return resp.IsChanged, resp.VersionId, nil
+}
+
+// Links selected by query, nil for all of them
+func (c *Client) Links(ctx context.Context, query *LinkQuery) (*LinkSet, error) {
+	var set LinkSet
+	if err := c.do(ctx, http.MethodGet, "/query_detect_links?"+query.values().Encode(), nil, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// Masks returns the links with a non zero exception mask
+func (c *Client) Masks(ctx context.Context) (*MaskSet, error) {
+	var set MaskSet
+	if err := c.do(ctx, http.MethodGet, "/query_link_masks", nil, &set); err != nil {
+		return nil, err
+	}
+	return &set, nil
+}
+
+// PostMasks posts the masks by batches, in order. Posting a mask again is
+// harmless, so a failed batch may be posted again by the caller.
+//
+// The server drops the masks of the names it does not know and writes the
+// others, so a nil error does not mean all the masks are written: they are
+// in the Rejected of the result. A batch of which no mask is known fails
+// with an APIError. The result tells the batches posted before a failure.
+func (c *Client) PostMasks(ctx context.Context, masks []Mask) (*PostResult, error) {
+	result := &PostResult{}
+	for start := 0; start < len(masks); start += c.batchSize {
+		end := start + c.batchSize
+		if end > len(masks) {
+			end = len(masks)
+		}
+		body, err := json.Marshal(masks[start:end])
+		if err != nil {
+			return result, &BatchError{Posted: start, Err: err}
+		}
+		var resp struct {
+			Accepted int    `json:"accepted"`
+			Rejected []Mask `json:"rejected"`
+		}
+		if err = c.do(ctx, http.MethodPost, "/post_detect_links_change", body, &resp); err != nil {
+			return result, &BatchError{Posted: start, Err: err}
+		}
+		result.Accepted += resp.Accepted
+		result.Rejected = append(result.Rejected, resp.Rejected...)
+	}
+	return result, nil
+}
+
+// Watch calls handle with the current links of query, then with the links
+// of every new version found by polling every interval. The errors of the
+// server are given to the error handler and the polling goes on, Watch only
+// returns when ctx is done, with the error of handle, or at once when
+// interval is not positive.
+func (c *Client) Watch(ctx context.Context, query *LinkQuery, interval time.Duration, handle func(set *LinkSet) error) error {
+	if interval <= 0 {
+		return fmt.Errorf("watch interval %v is not positive", interval)
+	}
+	var versionId int64
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		changed, _, err := c.Changed(ctx, versionId)
+		if err == nil && changed {
+			var set *LinkSet
+			if set, err = c.Links(ctx, query); err == nil {
+				// the version of the links, which may be newer than the one
+				// polled
+				versionId = set.VersionId
+				if err = handle(set); err != nil {
+					return err
+				}
+			}
+		}
+		if err != nil && ctx.Err() == nil {
+			c.onError(err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer serves the version and the links set by the test, and records
+// the masks posted
+type fakeServer struct {
+	*httptest.Server
+
+	mu sync.Mutex
+	// the status of the next requests, then 200
+	failures []int
+	version  int64
+	links    []Link
+	posted   [][]Mask
+	// errno of the posts
+	postErrno int
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{}
+	f.Server = httptest.NewServer(http.HandlerFunc(f.serve))
+	t.Cleanup(f.Close)
+	return f
+}
+
+func (f *fakeServer) set(version int64, links []Link) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.version, f.links = version, links
+}
+
+func (f *fakeServer) batches() [][]Mask {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.posted
+}
+
+func (f *fakeServer) fail(statuses ...int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures = append(f.failures, statuses...)
+}
+
+func (f *fakeServer) serve(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.failures) > 0 {
+		w.WriteHeader(f.failures[0])
+		f.failures = f.failures[1:]
+		return
+	}
+	var resp interface{}
+	switch r.URL.Path {
+	case "/is_detect_link_changed":
+		versionId, _ := strconv.ParseInt(r.URL.Query().Get("version_id"), 10, 64)
+		resp = map[string]interface{}{"errno": 0, "is_changed": versionId != f.version, "version_id": f.version}
+	case "/query_detect_links":
+		resp = map[string]interface{}{"errno": 0, "version_id": f.version, "links": f.links}
+	case "/post_detect_links_change":
+		var masks []Mask
+		body, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(body, &masks); err != nil {
+			resp = map[string]interface{}{"errno": 1, "error": err.Error()}
+			break
+		}
+		if f.postErrno != 0 {
+			resp = map[string]interface{}{"errno": f.postErrno, "error": "invalid link"}
+			break
+		}
+		f.posted = append(f.posted, masks)
+		// the idc unknown is not in the dictionaries
+		accepted, rejected := 0, []Mask{}
+		for _, mask := range masks {
+			if mask.Idc == "unknown" {
+				rejected = append(rejected, mask)
+			} else {
+				accepted++
+			}
+		}
+		resp = map[string]interface{}{"errno": 0, "accepted": accepted, "rejected": rejected}
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func TestRetries(t *testing.T) {
+	f := newFakeServer(t)
+	f.set(7, nil)
+	c := New(f.URL, WithRetries(2, time.Millisecond))
+
+	f.fail(http.StatusBadGateway, http.StatusServiceUnavailable)
+	changed, versionId, err := c.Changed(context.Background(), 0)
+	if err != nil || !changed || versionId != 7 {
+		t.Errorf("got %v %d %v, want a change to version 7", changed, versionId, err)
+	}
+
+	f.fail(http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+	if _, _, err = c.Changed(context.Background(), 0); err == nil {
+		t.Error("the request should fail after 2 retries")
+	}
+	// a refused request is not retried
+	f.fail(http.StatusBadRequest)
+	if _, _, err = c.Changed(context.Background(), 0); err == nil || err.Error() != "http status 400" {
+		t.Errorf("unexpected error %v", err)
+	}
+	if _, _, err = c.Changed(context.Background(), 7); err != nil {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestPostMasks(t *testing.T) {
+	f := newFakeServer(t)
+	c := New(f.URL, WithRetries(1, time.Millisecond), WithBatchSize(2))
+
+	masks := make([]Mask, 5)
+	for i := range masks {
+		masks[i] = Mask{Nation: "china", Province: "beijing", Isp: "telecom", Idc: fmt.Sprintf("idc-%d", i), ExceptionMask: 1}
+	}
+	if result, err := c.PostMasks(context.Background(), masks[:2]); err != nil || result.Accepted != 2 || len(result.Rejected) != 0 {
+		t.Fatalf("post masks got %+v, %v", result, err)
+	}
+	// the first batch of the masks left is retried, and the unknown idc of
+	// the last one is told back
+	masks[4].Idc = "unknown"
+	f.fail(http.StatusInternalServerError)
+	result, err := c.PostMasks(context.Background(), masks[2:])
+	if err != nil || result.Accepted != 2 || len(result.Rejected) != 1 || result.Rejected[0] != masks[4] {
+		t.Fatalf("post masks got %+v, %v", result, err)
+	}
+	if batches := f.batches(); len(batches) != 3 || len(batches[0]) != 2 || len(batches[1]) != 2 || len(batches[2]) != 1 || batches[2][0].Idc != "unknown" {
+		t.Errorf("unexpected batches %+v", batches)
+	}
+
+	f.mu.Lock()
+	f.postErrno = 2
+	f.mu.Unlock()
+	_, err = c.PostMasks(context.Background(), masks)
+	var batchErr *BatchError
+	var apiErr *APIError
+	if !errors.As(err, &batchErr) || batchErr.Posted != 0 || !errors.As(batchErr.Err, &apiErr) || apiErr.Errno != 2 {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	f := newFakeServer(t)
+	f.set(1, []Link{{Nation: "china", Province: "beijing", Isp: "telecom", Idc: "bj-idc-1", Priority: 1, Weight: 100}})
+	var mu sync.Mutex
+	var watchErrs []error
+	c := New(f.URL, WithRetries(0, time.Millisecond), WithErrorHandler(func(err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		watchErrs = append(watchErrs, err)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sets := make(chan *LinkSet)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watch(ctx, nil, 5*time.Millisecond, func(set *LinkSet) error {
+			sets <- set
+			return nil
+		})
+	}()
+	receive := func() *LinkSet {
+		select {
+		case set := <-sets:
+			return set
+		case <-time.After(5 * time.Second):
+			t.Fatal("no link set received")
+			return nil
+		}
+	}
+
+	if set := receive(); set.VersionId != 1 || len(set.Links) != 1 || set.Links[0].Idc != "bj-idc-1" {
+		t.Errorf("unexpected link set %+v", set)
+	}
+	// the watch goes on after a failed poll
+	f.fail(http.StatusBadGateway)
+	f.set(2, nil)
+	if set := receive(); set.VersionId != 2 || len(set.Links) != 0 {
+		t.Errorf("unexpected link set %+v", set)
+	}
+	mu.Lock()
+	if len(watchErrs) != 1 {
+		t.Errorf("got errors %v, want 1 error", watchErrs)
+	}
+	mu.Unlock()
+
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("watch returned %v", err)
+	}
+}
+
+func TestWatchHandlerError(t *testing.T) {
+	f := newFakeServer(t)
+	f.set(1, nil)
+	c := New(f.URL)
+	stop := errors.New("stop")
+	if err := c.Watch(context.Background(), nil, time.Millisecond, func(set *LinkSet) error { return stop }); err != stop {
+		t.Errorf("watch returned %v, want the error of the handler", err)
+	}
+}
+
+func TestWatchInvalidInterval(t *testing.T) {
+	c := New(newFakeServer(t).URL)
+	for _, interval := range []time.Duration{0, -time.Second} {
+		err := c.Watch(context.Background(), nil, interval, func(set *LinkSet) error {
+			t.Error("the links should not be handled")
+			return nil
+		})
+		if err == nil {
+			t.Errorf("watch with interval %v should fail", interval)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"database/sql/driver"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"links_manage/client"
+	"links_manage/db_operation"
+)
+
+// the client package against an in-process server
+func TestClient(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, oss, mock := startTestServer(t, testConfig())
+	ts := httptest.NewServer(s.Router())
+	defer ts.Close()
+	c := client.New(ts.URL, client.WithRetries(0, time.Millisecond), client.WithBatchSize(1))
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	sets := make(chan *client.LinkSet)
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Watch(ctx, &client.LinkQuery{Ips: true}, 10*time.Millisecond, func(set *client.LinkSet) error {
+			sets <- set
+			return nil
+		})
+	}()
+	set := <-sets
+	if set.VersionId != s.snapshot().versionId || len(set.Links) != 5 {
+		t.Fatalf("unexpected link set %+v", set)
+	}
+	for _, link := range set.Links {
+		if link.Province == "beijing" && link.Isp == "mobile" && link.Idc == "bj-idc-1" && (link.Weight != 80 || len(link.Ips) != 1) {
+			t.Errorf("unexpected link %+v", link)
+		}
+	}
+
+	// beijing/mobile is no longer covered by gz-idc-1
+	oss.SetFixture("res_cover_102.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"res_id": 102, "cover": [
+		{"area_id": -11, "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 21, "weight": "80",
+			"idcs": [{"idc_id": 1001, "ips": []}]}]}]}`)
+	if err := s.updateLinkData([]linkdb.OssDb{{Master: oss.Addr, Slaver: oss.Addr}}); err != nil {
+		t.Fatalf("update link data failed: %v", err)
+	}
+	set = <-sets
+	if set.VersionId != s.snapshot().versionId || len(set.Links) != 4 {
+		t.Errorf("unexpected link set %+v", set)
+	}
+	cancel()
+	if err := <-done; err != context.Canceled {
+		t.Errorf("watch returned %v", err)
+	}
+
+	// one batch by mask
+	for _, args := range [][]driver.Value{{156, 11, 1, 1001, 1, "127.0.0.1"}, {156, 44, 2, 1002, 0, "127.0.0.1"}} {
+		mock.ExpectExec(updateLinkMaskSql).
+			WithArgs(args...).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+	}
+	masks := []client.Mask{
+		{Nation: "china", Province: "beijing", Isp: "telecom", Idc: "bj-idc-1", ExceptionMask: 1},
+		{Nation: "china", Province: "guangdong", Isp: "unicom", Idc: "gz-idc-1"},
+	}
+	if result, err := c.PostMasks(context.Background(), masks); err != nil || result.Accepted != 2 || len(result.Rejected) != 0 {
+		t.Fatalf("post masks got %+v, %v", result, err)
+	}
+	mock.ExpectQuery(getLinkMaskRecordsSql).
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask", "updated_by", "ctime"}).
+			AddRow(156, 11, 1, 1001, 1, "127.0.0.1", 1700000000))
+	maskSet, err := c.Masks(context.Background())
+	if err != nil {
+		t.Fatalf("get masks failed: %v", err)
+	}
+	got := maskSet.Masks
+	if len(got) != 1 || maskSet.Untranslated != 0 || got[0].Mask != masks[0] || got[0].UpdatedBy != "127.0.0.1" || got[0].UpdateTime.Unix() != 1700000000 {
+		t.Errorf("got masks %+v, want %+v", maskSet, masks[:1])
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
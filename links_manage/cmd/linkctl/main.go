@@ -0,0 +1,507 @@
+// linkctl is the command-line client of the links_manage server for the
+// operators, it talks to the http api of the server with links_manage/client.
+//
+//	linkctl [flags] links [-nation n] [-province p] [-city c] [-area a] [-isp i] [-idc d] [-granularity g] [-weights]
+//	linkctl [flags] version
+//	linkctl [flags] masks
+//	linkctl [flags] post-masks [-dry-run] <file.csv|file.json>
+//	linkctl [flags] diff <file|live> <file|live>
+//
+// A file of links is the json output of the links command, so the links of a
+// version are kept with `linkctl -o json links > v1.json` and compared later
+// with `linkctl diff v1.json live`, which also tells the links whose priority
+// or weight changed. The masks are posted from a json array of links with an
+// exception_mask, as printed by `linkctl -o json masks`, or from a csv with a
+// header naming the columns nation, province, isp, idc_name and
+// exception_mask. The masks of the names the server does not know are
+// rejected and printed.
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"links_manage/client"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// ctl is a command run against a server
+type ctl struct {
+	output string
+	client *client.Client
+	ctx    context.Context
+	stdout io.Writer
+}
+
+var errUsage = errors.New("usage")
+
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("linkctl", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	defaultServer := os.Getenv("LINKCTL_SERVER")
+	if defaultServer == "" {
+		defaultServer = "http://127.0.0.1:12365"
+	}
+	server := flags.String("server", defaultServer, "url of the server, $LINKCTL_SERVER by default")
+	output := flags.String("o", "table", "output format, table or json")
+	timeout := flags.Duration("timeout", 10*time.Second, "timeout of a request")
+	caFile := flags.String("cacert", "", "ca file to verify the server with https")
+	certFile := flags.String("cert", "", "client certificate for mtls")
+	keyFile := flags.String("key", "", "key of the client certificate")
+	flags.Usage = func() {
+		fmt.Fprintln(stderr, "usage: linkctl [flags] links|version|masks|post-masks|diff [args]")
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintf(stderr, "unknown output format %s\n", *output)
+		return 2
+	}
+	httpClient, err := newHttpClient(*timeout, *caFile, *certFile, *keyFile)
+	if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 1
+	}
+	// the operator retries a command failed
+	c := &ctl{
+		output: *output,
+		client: client.New(*server, client.WithHTTPClient(httpClient), client.WithRetries(0, 0)),
+		ctx:    context.Background(),
+		stdout: stdout,
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+	commands := map[string]func(args []string) error{
+		"links":      c.links,
+		"version":    c.version,
+		"masks":      c.masks,
+		"post-masks": c.postMasks,
+		"diff":       c.diff,
+	}
+	command, ok := commands[flags.Arg(0)]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command %s\n", flags.Arg(0))
+		flags.Usage()
+		return 2
+	}
+	if err = command(flags.Args()[1:]); err != nil {
+		if err == errUsage {
+			return 2
+		}
+		fmt.Fprintf(stderr, "%s failed: %s\n", flags.Arg(0), err.Error())
+		return 1
+	}
+	return 0
+}
+
+func newHttpClient(timeout time.Duration, caFile, certFile, keyFile string) (*http.Client, error) {
+	tlsConfig := &tls.Config{}
+	if caFile != "" {
+		pem, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("read ca file failed: %s", err.Error())
+		}
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in ca file %s", caFile)
+		}
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client certificate failed: %s", err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return &http.Client{Timeout: timeout, Transport: &http.Transport{TLSClientConfig: tlsConfig}}, nil
+}
+
+// linkName identifies a link, it is the filter of the links command
+type linkName struct {
+	Nation   string `json:"nation"`
+	Province string `json:"province"`
+	City     string `json:"city,omitempty"`
+	Area     string `json:"area,omitempty"`
+	Isp      string `json:"isp"`
+	Idc      string `json:"idc_name"`
+}
+
+func nameOf(l *client.Link) linkName {
+	return linkName{Nation: l.Nation, Province: l.Province, City: l.City, Area: l.Area, Isp: l.Isp, Idc: l.Idc}
+}
+
+func (name *linkName) columns() []string {
+	return []string{name.Nation, name.Province, name.City, name.Area, name.Isp, name.Idc}
+}
+
+func linkColumns(l *client.Link) []string {
+	name := nameOf(l)
+	return name.columns()
+}
+
+func maskColumns(mask *client.Mask) []string {
+	return []string{mask.Nation, mask.Province, mask.Isp, mask.Idc, strconv.FormatInt(mask.ExceptionMask, 10)}
+}
+
+// the links of the server, a file of links is the json of the LinkSet
+func (c *ctl) fetchLinks(granularity string) (*client.LinkSet, error) {
+	return c.client.Links(c.ctx, &client.LinkQuery{Granularity: granularity})
+}
+
+func (c *ctl) links(args []string) error {
+	flags := flag.NewFlagSet("links", flag.ContinueOnError)
+	var filter linkName
+	flags.StringVar(&filter.Nation, "nation", "", "only the links of the nation")
+	flags.StringVar(&filter.Province, "province", "", "only the links of the province")
+	flags.StringVar(&filter.City, "city", "", "only the links of the city")
+	flags.StringVar(&filter.Area, "area", "", "only the links of the area")
+	flags.StringVar(&filter.Isp, "isp", "", "only the links of the isp")
+	flags.StringVar(&filter.Idc, "idc", "", "only the links of the idc")
+	granularity := flags.String("granularity", "", "city or province")
+	weights := flags.Bool("weights", false, "show the priority and the weight of the table")
+	if err := flags.Parse(args); err != nil {
+		return errUsage
+	}
+	set, err := c.fetchLinks(*granularity)
+	if err != nil {
+		return err
+	}
+	var selected []client.Link
+	for _, l := range set.Links {
+		if name := nameOf(&l); matchLink(&name, &filter) {
+			selected = append(selected, l)
+		}
+	}
+	set.Links = selected
+	if c.output == "json" {
+		return c.printJSON(set)
+	}
+	header := []string{"NATION", "PROVINCE", "CITY", "AREA", "ISP", "IDC"}
+	if *weights {
+		header = append(header, "PRIORITY", "WEIGHT")
+	}
+	rows := make([][]string, 0, len(set.Links))
+	for _, l := range set.Links {
+		row := linkColumns(&l)
+		if *weights {
+			row = append(row, strconv.FormatInt(l.Priority, 10), formatWeight(l.Weight))
+		}
+		rows = append(rows, row)
+	}
+	fmt.Fprintf(c.stdout, "version %d, %d links\n", set.VersionId, len(rows))
+	return c.printTable(header, rows)
+}
+
+// the empty fields of filter match all
+func matchLink(name, filter *linkName) bool {
+	match := func(value, wanted string) bool { return wanted == "" || value == wanted }
+	return match(name.Nation, filter.Nation) && match(name.Province, filter.Province) &&
+		match(name.City, filter.City) && match(name.Area, filter.Area) &&
+		match(name.Isp, filter.Isp) && match(name.Idc, filter.Idc)
+}
+
+func (c *ctl) version(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	// no version is 0, so the current one is always returned
+	_, versionId, err := c.client.Changed(c.ctx, 0)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(struct {
+			VersionId int64 `json:"version_id"`
+		}{versionId})
+	}
+	fmt.Fprintln(c.stdout, versionId)
+	return nil
+}
+
+func (c *ctl) masks(args []string) error {
+	if len(args) != 0 {
+		return errUsage
+	}
+	set, err := c.client.Masks(c.ctx)
+	if err != nil {
+		return err
+	}
+	if c.output == "json" {
+		return c.printJSON(set.Masks)
+	}
+	rows := make([][]string, 0, len(set.Masks))
+	for i := range set.Masks {
+		mask := &set.Masks[i]
+		rows = append(rows, append(maskColumns(&mask.Mask), mask.UpdatedBy, mask.UpdateTime.Format(time.RFC3339)))
+	}
+	fmt.Fprintf(c.stdout, "%d masks, %d without names\n", len(rows), set.Untranslated)
+	return c.printTable([]string{"NATION", "PROVINCE", "ISP", "IDC", "MASK", "UPDATED_BY", "UPDATED"}, rows)
+}
+
+func (c *ctl) postMasks(args []string) error {
+	flags := flag.NewFlagSet("post-masks", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "print the masks instead of posting them")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 {
+		return errUsage
+	}
+	masks, err := readMasks(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	if len(masks) == 0 {
+		return fmt.Errorf("no mask in %s", flags.Arg(0))
+	}
+	if *dryRun {
+		return c.printJSON(masks)
+	}
+	// the masks of the names unknown to the server are rejected and the
+	// others written
+	result, err := c.client.PostMasks(c.ctx, masks)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.stdout, "posted %d masks, %d accepted, %d rejected\n", len(masks), result.Accepted, len(result.Rejected))
+	if len(result.Rejected) == 0 {
+		return nil
+	}
+	rows := make([][]string, 0, len(result.Rejected))
+	for i := range result.Rejected {
+		rows = append(rows, maskColumns(&result.Rejected[i]))
+	}
+	return c.printTable([]string{"NATION", "PROVINCE", "ISP", "IDC", "MASK"}, rows)
+}
+
+// the masks of a json or csv file, by its extension
+func readMasks(path string) ([]client.Mask, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		var masks []client.Mask
+		if err = json.Unmarshal(content, &masks); err != nil {
+			return nil, fmt.Errorf("decode %s failed: %s", path, err.Error())
+		}
+		return masks, nil
+	case ".csv":
+		return parseMasksCsv(content)
+	}
+	return nil, fmt.Errorf("%s is neither a .json nor a .csv file", path)
+}
+
+func parseMasksCsv(content []byte) ([]client.Mask, error) {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	columns := make(map[string]int)
+	for i, name := range records[0] {
+		columns[strings.TrimSpace(name)] = i
+	}
+	for _, name := range []string{"nation", "province", "isp", "idc_name", "exception_mask"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("no column %s in the csv header", name)
+		}
+	}
+	field := func(record []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(record) {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+	masks := make([]client.Mask, 0, len(records)-1)
+	for line, record := range records[1:] {
+		mask := client.Mask{
+			Nation:   field(record, "nation"),
+			Province: field(record, "province"),
+			Isp:      field(record, "isp"),
+			Idc:      field(record, "idc_name"),
+		}
+		if mask.ExceptionMask, err = strconv.ParseInt(field(record, "exception_mask"), 10, 64); err != nil {
+			return nil, fmt.Errorf("line %d: invalid exception_mask %q", line+2, field(record, "exception_mask"))
+		}
+		masks = append(masks, mask)
+	}
+	return masks, nil
+}
+
+// a file of the links command, or the links of the server for "live"
+func (c *ctl) loadLinkSet(source string) (*client.LinkSet, error) {
+	if source == "live" {
+		return c.fetchLinks("")
+	}
+	content, err := ioutil.ReadFile(source)
+	if err != nil {
+		return nil, err
+	}
+	var set client.LinkSet
+	if err = json.Unmarshal(content, &set); err != nil {
+		return nil, fmt.Errorf("decode %s failed: %s", source, err.Error())
+	}
+	return &set, nil
+}
+
+// linkDiff is the links added, removed and changed from a version to another
+type linkDiff struct {
+	From    int64         `json:"from_version_id"`
+	To      int64         `json:"to_version_id"`
+	Added   []client.Link `json:"added"`
+	Removed []client.Link `json:"removed"`
+	Changed []linkChange  `json:"changed"`
+}
+
+// linkChange is a link in both versions with another priority or weight
+type linkChange struct {
+	linkName
+	FromPriority int64   `json:"from_priority"`
+	ToPriority   int64   `json:"to_priority"`
+	FromWeight   float64 `json:"from_weight"`
+	ToWeight     float64 `json:"to_weight"`
+}
+
+func diffLinks(from, to *client.LinkSet) *linkDiff {
+	byName := func(set *client.LinkSet) map[linkName]client.Link {
+		result := make(map[linkName]client.Link)
+		for _, l := range set.Links {
+			result[nameOf(&l)] = l
+		}
+		return result
+	}
+	fromLinks, toLinks := byName(from), byName(to)
+	diff := &linkDiff{From: from.VersionId, To: to.VersionId}
+	for name, l := range toLinks {
+		old, ok := fromLinks[name]
+		if !ok {
+			diff.Added = append(diff.Added, l)
+		} else if old.Priority != l.Priority || old.Weight != l.Weight {
+			diff.Changed = append(diff.Changed, linkChange{
+				linkName:     name,
+				FromPriority: old.Priority,
+				ToPriority:   l.Priority,
+				FromWeight:   old.Weight,
+				ToWeight:     l.Weight,
+			})
+		}
+	}
+	for name, l := range fromLinks {
+		if _, ok := toLinks[name]; !ok {
+			diff.Removed = append(diff.Removed, l)
+		}
+	}
+	sortLinks(diff.Added)
+	sortLinks(diff.Removed)
+	sort.Slice(diff.Changed, func(i, j int) bool {
+		return lessNames(&diff.Changed[i].linkName, &diff.Changed[j].linkName)
+	})
+	return diff
+}
+
+func sortLinks(links []client.Link) {
+	sort.Slice(links, func(i, j int) bool {
+		a, b := nameOf(&links[i]), nameOf(&links[j])
+		return lessNames(&a, &b)
+	})
+}
+
+func lessNames(x, y *linkName) bool {
+	a, b := x.columns(), y.columns()
+	for k := range a {
+		if a[k] != b[k] {
+			return a[k] < b[k]
+		}
+	}
+	return false
+}
+
+func (c *ctl) diff(args []string) error {
+	if len(args) != 2 {
+		return errUsage
+	}
+	from, err := c.loadLinkSet(args[0])
+	if err != nil {
+		return err
+	}
+	to, err := c.loadLinkSet(args[1])
+	if err != nil {
+		return err
+	}
+	diff := diffLinks(from, to)
+	if c.output == "json" {
+		return c.printJSON(diff)
+	}
+	fmt.Fprintf(c.stdout, "version %d to %d, %d added, %d removed, %d changed\n",
+		diff.From, diff.To, len(diff.Added), len(diff.Removed), len(diff.Changed))
+	rows := make([][]string, 0, len(diff.Added)+len(diff.Removed)+len(diff.Changed))
+	row := func(mark string, l *client.Link) []string {
+		row := append([]string{mark}, linkColumns(l)...)
+		return append(row, strconv.FormatInt(l.Priority, 10), formatWeight(l.Weight))
+	}
+	for i := range diff.Added {
+		rows = append(rows, row("+", &diff.Added[i]))
+	}
+	for i := range diff.Removed {
+		rows = append(rows, row("-", &diff.Removed[i]))
+	}
+	// the priority and the weight from the old version to the new one
+	for i := range diff.Changed {
+		change := &diff.Changed[i]
+		rows = append(rows, append(append([]string{"~"}, change.columns()...),
+			strconv.FormatInt(change.FromPriority, 10)+" -> "+strconv.FormatInt(change.ToPriority, 10),
+			formatWeight(change.FromWeight)+" -> "+formatWeight(change.ToWeight)))
+	}
+	return c.printTable([]string{"", "NATION", "PROVINCE", "CITY", "AREA", "ISP", "IDC", "PRIORITY", "WEIGHT"}, rows)
+}
+
+func formatWeight(weight float64) string {
+	return strconv.FormatFloat(weight, 'f', -1, 64)
+}
+
+func (c *ctl) printJSON(v interface{}) error {
+	encoder := json.NewEncoder(c.stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(v)
+}
+
+// empty cells are printed as -
+func (c *ctl) printTable(header []string, rows [][]string) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, strings.Join(header, "\t"))
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, cell := range row {
+			if cell == "" {
+				cell = "-"
+			}
+			cells[i] = cell
+		}
+		fmt.Fprintln(w, strings.Join(cells, "\t"))
+	}
+	return w.Flush()
+}
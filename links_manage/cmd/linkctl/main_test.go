@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"links_manage/client"
+)
+
+// fake server answering the api used by linkctl, the masks posted are kept
+// and those of the idc nowhere-idc are rejected
+type fakeServer struct {
+	*httptest.Server
+	posted []client.Mask
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	f := &fakeServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/query_detect_links", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errno": 0, "error": "", "version_id": 7, "links": [
+			{"nation": "china", "province": "beijing", "isp": "telecom", "idc_name": "bj-idc-1", "priority": 1, "weight": 100},
+			{"nation": "china", "province": "guangdong", "isp": "unicom", "idc_name": "gz-idc-1", "priority": 2, "weight": 50}]}`))
+	})
+	mux.HandleFunc("/is_detect_link_changed", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errno": 0, "error": "", "is_changed": true, "version_id": 7}`))
+	})
+	mux.HandleFunc("/query_link_masks", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"errno": 0, "error": "", "count": 1, "untranslated": 0, "masks": [
+			{"nation": "china", "province": "beijing", "isp": "telecom", "idc_name": "bj-idc-1", "exception_mask": 1,
+				"updated_by": "prober-1", "update_time": "2023-11-14T22:13:20Z"}]}`))
+	})
+	mux.HandleFunc("/post_detect_links_change", func(w http.ResponseWriter, r *http.Request) {
+		if err := json.NewDecoder(r.Body).Decode(&f.posted); err != nil {
+			w.Write([]byte(`{"errno": 1, "error": "decode post json failed"}`))
+			return
+		}
+		accepted, rejected := 0, []client.Mask{}
+		for _, mask := range f.posted {
+			if mask.Idc == "nowhere-idc" {
+				rejected = append(rejected, mask)
+			} else {
+				accepted++
+			}
+		}
+		content, _ := json.Marshal(map[string]interface{}{"errno": 0, "error": "", "accepted": accepted, "rejected": rejected})
+		w.Write(content)
+	})
+	f.Server = httptest.NewServer(mux)
+	t.Cleanup(f.Close)
+	return f
+}
+
+func runCtl(t *testing.T, server string, args ...string) (string, int) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(append([]string{"-server", server}, args...), &stdout, &stderr)
+	if code != 0 {
+		t.Logf("stderr: %s", stderr.String())
+	}
+	return stdout.String(), code
+}
+
+func TestLinks(t *testing.T) {
+	server := newFakeServer(t)
+	out, code := runCtl(t, server.URL, "-o", "json", "links", "-province", "beijing")
+	if code != 0 {
+		t.Fatalf("links exits with %d", code)
+	}
+	var set client.LinkSet
+	if err := json.Unmarshal([]byte(out), &set); err != nil {
+		t.Fatalf("decode output %s failed: %v", out, err)
+	}
+	if set.VersionId != 7 || len(set.Links) != 1 || set.Links[0].Idc != "bj-idc-1" || set.Links[0].Weight != 100 {
+		t.Errorf("unexpected links %+v", set)
+	}
+
+	out, code = runCtl(t, server.URL, "links", "-weights")
+	if code != 0 || !strings.Contains(out, "version 7, 2 links") || !strings.Contains(out, "gz-idc-1") || !strings.Contains(out, "WEIGHT") {
+		t.Errorf("unexpected table %s", out)
+	}
+}
+
+func TestVersionAndMasks(t *testing.T) {
+	server := newFakeServer(t)
+	if out, code := runCtl(t, server.URL, "version"); code != 0 || out != "7\n" {
+		t.Errorf("version prints %q and exits with %d", out, code)
+	}
+	out, code := runCtl(t, server.URL, "masks")
+	if code != 0 || !strings.Contains(out, "1 masks") || !strings.Contains(out, "bj-idc-1") || !strings.Contains(out, "prober-1") {
+		t.Errorf("unexpected masks %s", out)
+	}
+}
+
+func TestPostMasks(t *testing.T) {
+	server := newFakeServer(t)
+	dir := t.TempDir()
+	csvFile := filepath.Join(dir, "masks.csv")
+	content := "nation,province,isp,idc_name,exception_mask\nchina,beijing,telecom,bj-idc-1,1\nchina,guangdong,unicom,gz-idc-1,0\n" +
+		"china,beijing,telecom,nowhere-idc,1\n"
+	if err := ioutil.WriteFile(csvFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runCtl(t, server.URL, "post-masks", csvFile)
+	if code != 0 {
+		t.Fatalf("post-masks exits with %d", code)
+	}
+	if !strings.Contains(out, "posted 3 masks, 2 accepted, 1 rejected") || !strings.Contains(out, "nowhere-idc") {
+		t.Errorf("unexpected output %s", out)
+	}
+	want := []client.Mask{
+		{Nation: "china", Province: "beijing", Isp: "telecom", Idc: "bj-idc-1", ExceptionMask: 1},
+		{Nation: "china", Province: "guangdong", Isp: "unicom", Idc: "gz-idc-1", ExceptionMask: 0},
+		{Nation: "china", Province: "beijing", Isp: "telecom", Idc: "nowhere-idc", ExceptionMask: 1},
+	}
+	if !reflect.DeepEqual(server.posted, want) {
+		t.Errorf("posted %+v, want %+v", server.posted, want)
+	}
+
+	// the json output of masks is posted back as is
+	server.posted = nil
+	jsonFile := filepath.Join(dir, "masks.json")
+	out, _ = runCtl(t, server.URL, "-o", "json", "masks")
+	if err := ioutil.WriteFile(jsonFile, []byte(out), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runCtl(t, server.URL, "post-masks", jsonFile); code != 0 || len(server.posted) != 1 {
+		t.Errorf("post-masks exits with %d, posted %+v", code, server.posted)
+	}
+
+	badFile := filepath.Join(dir, "bad.csv")
+	if err := ioutil.WriteFile(badFile, []byte("nation,province,isp,idc_name,exception_mask\nchina,beijing,telecom,bj-idc-1,on\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, code := runCtl(t, server.URL, "post-masks", badFile); code != 1 {
+		t.Errorf("post-masks of a bad csv exits with %d", code)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	server := newFakeServer(t)
+	old := client.LinkSet{VersionId: 6, Links: []client.Link{
+		{Nation: "china", Province: "beijing", Isp: "telecom", Idc: "bj-idc-1", Priority: 1, Weight: 80},
+		{Nation: "china", Province: "tianjin", Isp: "telecom", Idc: "bj-idc-1"},
+	}}
+	content, _ := json.Marshal(&old)
+	oldFile := filepath.Join(t.TempDir(), "v6.json")
+	if err := ioutil.WriteFile(oldFile, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	out, code := runCtl(t, server.URL, "-o", "json", "diff", oldFile, "live")
+	if code != 0 {
+		t.Fatalf("diff exits with %d", code)
+	}
+	var diff linkDiff
+	if err := json.Unmarshal([]byte(out), &diff); err != nil {
+		t.Fatalf("decode output %s failed: %v", out, err)
+	}
+	if diff.From != 6 || diff.To != 7 || len(diff.Added) != 1 || diff.Added[0].Province != "guangdong" ||
+		len(diff.Removed) != 1 || diff.Removed[0].Province != "tianjin" {
+		t.Errorf("unexpected diff %+v", diff)
+	}
+	// beijing telecom is weighted 80 in v6 and 100 live
+	wantChanged := []linkChange{{
+		linkName:     linkName{Nation: "china", Province: "beijing", Isp: "telecom", Idc: "bj-idc-1"},
+		FromPriority: 1,
+		ToPriority:   1,
+		FromWeight:   80,
+		ToWeight:     100,
+	}}
+	if !reflect.DeepEqual(diff.Changed, wantChanged) {
+		t.Errorf("got changed %+v, want %+v", diff.Changed, wantChanged)
+	}
+
+	out, code = runCtl(t, server.URL, "diff", oldFile, "live")
+	if code != 0 || !strings.Contains(out, "1 added, 1 removed, 1 changed") || !strings.Contains(out, "80 -> 100") {
+		t.Errorf("unexpected table %s", out)
+	}
+}
+
+func TestUsage(t *testing.T) {
+	var stdout, stderr bytes.Buffer
+	for _, args := range [][]string{{}, {"unknown"}, {"-o", "xml", "links"}, {"diff", "live"}} {
+		if code := run(args, &stdout, &stderr); code != 2 {
+			t.Errorf("%v exits with %d, want 2", args, code)
+		}
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"github.com/go-ini/ini"
+	"github.com/golang/glog"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type DBConfig struct {
+	Host         string
+	Port         int
+	Db           string
+	User         string
+	Passwd       string
+	Charset      string
+	MaxOpenConns int
+	MaxIdleConns int
+	MaxLifeTime  time.Duration
+}
+
+// RefreshConfig is the part of the config which is reloaded without restart,
+// it is swapped as a whole and must not be modified once used by a server
+type RefreshConfig struct {
+	ValidIspIds    map[int64]bool
+	ValidNationIds map[int64]bool
+	// nations whose links are split by city, the others are by province
+	CityNationIds map[int64]bool
+	// nations whose covers of an area give links of the area, the others
+	// give links of its provinces
+	AreaNationIds    map[int64]bool
+	LinkUpdatePeriod time.Duration
+	IdcUpdatePeriod  time.Duration
+	GeoUpdatePeriod  time.Duration
+	// deadline of a whole refresh of geo, idc or links
+	RefreshTimeout time.Duration
+	CgiUser        string
+	CgiTimeout     time.Duration
+}
+
+// Config of a Server, see conf/server.ini
+type Config struct {
+	DB DBConfig
+	// see listenSpec, listenInterface is used when the listen key is empty
+	Listen           []string
+	ListenPort       int
+	LogFlushDuration time.Duration
+	TLS              TLSConfig
+	Leader           LeaderConfig
+	// time to drain the requests in flight on shutdown
+	ShutdownTimeout time.Duration
+	// period to refresh the coverage health metrics and check the alerts, 0
+	// disables the refresh
+	HealthPeriod time.Duration
+	Alert        AlertConfig
+	Webhooks     WebhookConfig
+	// file to reload RefreshConfig from on SIGHUP or when it is found modified,
+	// nothing is reloaded when empty
+	ConfigFile        string
+	ConfigCheckPeriod time.Duration
+	RefreshConfig
+}
+
+func loadValidIdMap(cfg *ini.File, keyName string) (map[int64]bool, error) {
+	validIdString := strings.Split(cfg.Section("server").Key(keyName).String(), ",")
+	validIds := make(map[int64]bool)
+	for _, val := range validIdString {
+		vId, err := strconv.ParseInt(val, 10, 64)
+		if err != nil {
+			glog.Errorf("convert  id failed %v", val)
+			return nil, fmt.Errorf("covert %s to int failed", val)
+		}
+		validIds[vId] = true
+	}
+	return validIds, nil
+}
+
+// an empty key gives an empty map
+func loadOptionalIdMap(cfg *ini.File, keyName string) (map[int64]bool, error) {
+	if cfg.Section("server").Key(keyName).String() == "" {
+		return make(map[int64]bool), nil
+	}
+	return loadValidIdMap(cfg, keyName)
+}
+
+func loadSeconds(section *ini.Section, keyName string, defaultVal int) (time.Duration, error) {
+	seconds := section.Key(keyName).MustInt(defaultVal)
+	if seconds <= 0 {
+		return 0, fmt.Errorf("%s must be positive, got %d", keyName, seconds)
+	}
+	return time.Second * time.Duration(seconds), nil
+}
+
+func loadRefreshConfig(cfg *ini.File) (*RefreshConfig, error) {
+	var conf RefreshConfig
+	var err error
+	if conf.ValidIspIds, err = loadValidIdMap(cfg, "validIspIds"); err != nil {
+		return nil, fmt.Errorf("load valid isp ids failed: %s", err.Error())
+	}
+	if conf.ValidNationIds, err = loadValidIdMap(cfg, "validNationIds"); err != nil {
+		return nil, fmt.Errorf("load valid nation ids failed: %s", err.Error())
+	}
+	if conf.CityNationIds, err = loadOptionalIdMap(cfg, "cityNationIds"); err != nil {
+		return nil, fmt.Errorf("load city nation ids failed: %s", err.Error())
+	}
+	if conf.AreaNationIds, err = loadOptionalIdMap(cfg, "areaNationIds"); err != nil {
+		return nil, fmt.Errorf("load area nation ids failed: %s", err.Error())
+	}
+	server := cfg.Section("server")
+	if conf.LinkUpdatePeriod, err = loadSeconds(server, "linkUpdatePeriod", 60); err != nil {
+		return nil, err
+	}
+	if conf.IdcUpdatePeriod, err = loadSeconds(server, "idcUpdatePeriod", 3600); err != nil {
+		return nil, err
+	}
+	if conf.GeoUpdatePeriod, err = loadSeconds(server, "geoUpdatePeriod", 86400); err != nil {
+		return nil, err
+	}
+	if conf.RefreshTimeout, err = loadSeconds(server, "refreshTimeout", 50); err != nil {
+		return nil, err
+	}
+	if conf.CgiTimeout, err = loadSeconds(cfg.Section("cgi"), "timeout", 5); err != nil {
+		return nil, err
+	}
+	conf.CgiUser = cfg.Section("cgi").Key("user").MustString("cloudywu")
+	return &conf, nil
+}
+
+// load the config of a server from an ini file
+func LoadConfig(configFile string) (*Config, error) {
+	cfg, err := ini.Load(configFile)
+	if err != nil {
+		return nil, fmt.Errorf("load config failed: %s", err.Error())
+	}
+	refreshConf, err := loadRefreshConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+	conf := Config{RefreshConfig: *refreshConf, ConfigFile: configFile}
+	dbSection := cfg.Section("DBConf")
+	conf.DB = DBConfig{
+		Host:         dbSection.Key("host").String(),
+		Port:         dbSection.Key("port").MustInt(3306),
+		Db:           dbSection.Key("db").String(),
+		User:         dbSection.Key("user").String(),
+		Passwd:       dbSection.Key("passwd").String(),
+		Charset:      dbSection.Key("charset").String(),
+		MaxOpenConns: dbSection.Key("maxOpenConns").MustInt(10),
+		MaxIdleConns: dbSection.Key("maxIdleConns").MustInt(5),
+		MaxLifeTime:  time.Second * time.Duration(dbSection.Key("maxLifeTimeSeconds").MustInt(10)),
+	}
+	server := cfg.Section("server")
+	conf.Listen = server.Key("listen").Strings(",")
+	if len(conf.Listen) == 0 {
+		conf.Listen = []string{server.Key("listenInterface").String()}
+	}
+	conf.ListenPort = server.Key("listenPort").MustInt(12365)
+	conf.ConfigCheckPeriod = time.Second * time.Duration(server.Key("configCheckPeriod").MustInt(10))
+	conf.ShutdownTimeout = time.Second * time.Duration(server.Key("shutdownTimeout").MustInt(30))
+	conf.HealthPeriod = time.Second * time.Duration(server.Key("healthPeriod").MustInt(60))
+	conf.LogFlushDuration = time.Second * time.Duration(cfg.Section("glog").Key("logFlushSecond").MustInt(1))
+	tlsSection := cfg.Section("tls")
+	conf.TLS = TLSConfig{
+		CertFile:     tlsSection.Key("certFile").String(),
+		KeyFile:      tlsSection.Key("keyFile").String(),
+		ClientCAFile: tlsSection.Key("clientCAFile").String(),
+	}
+	if err = conf.TLS.validate(); err != nil {
+		return nil, fmt.Errorf("invalid tls config: %s", err.Error())
+	}
+	leaderSection := cfg.Section("leader")
+	conf.Leader = LeaderConfig{
+		Enabled:       leaderSection.Key("enabled").MustBool(false),
+		Holder:        leaderSection.Key("holder").String(),
+		LeaseDuration: time.Second * time.Duration(leaderSection.Key("leaseSeconds").MustInt(30)),
+		PurgePeriod:   time.Second * time.Duration(leaderSection.Key("purgePeriod").MustInt(0)),
+	}
+	if conf.Leader.Holder == "" {
+		conf.Leader.Holder = defaultHolder()
+	}
+	if err = conf.Leader.validate(); err != nil {
+		return nil, fmt.Errorf("invalid leader config: %s", err.Error())
+	}
+	alertSection := cfg.Section("alert")
+	conf.Alert = AlertConfig{
+		Webhooks:          alertSection.Key("webhooks").Strings(","),
+		Secret:            alertSection.Key("secret").String(),
+		CoverageThreshold: alertSection.Key("coverageThreshold").MustFloat64(0),
+		IdcThreshold:      alertSection.Key("idcThreshold").MustFloat64(0),
+		GlobalThreshold:   alertSection.Key("globalThreshold").MustFloat64(0),
+		Timeout:           time.Second * time.Duration(alertSection.Key("timeout").MustInt(5)),
+	}
+	if err = conf.Alert.validate(); err != nil {
+		return nil, fmt.Errorf("invalid alert config: %s", err.Error())
+	}
+	if conf.Webhooks, err = loadWebhookConfig(cfg); err != nil {
+		return nil, fmt.Errorf("invalid webhook config: %s", err.Error())
+	}
+	return &conf, nil
+}
+
+func sameIds(a, b map[int64]bool) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for id := range a {
+		if !b[id] {
+			return false
+		}
+	}
+	return true
+}
+
+func resetTicker(ticker *time.Ticker, oldPeriod, newPeriod time.Duration) {
+	if oldPeriod != newPeriod {
+		ticker.Reset(newPeriod)
+	}
+}
+
+// load the config file again and swap in the refresh config, the old one is
+// kept when the new one is invalid
+func (s *Server) reloadConfig() error {
+	cfg, err := ini.Load(s.conf.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("load config failed: %s", err.Error())
+	}
+	newConf, err := loadRefreshConfig(cfg)
+	if err != nil {
+		return err
+	}
+	oldConf := s.refreshConfig()
+	s.setRefreshConfig(newConf)
+	resetTicker(s.geoTicker, oldConf.GeoUpdatePeriod, newConf.GeoUpdatePeriod)
+	resetTicker(s.idcTicker, oldConf.IdcUpdatePeriod, newConf.IdcUpdatePeriod)
+	resetTicker(s.linkTicker, oldConf.LinkUpdatePeriod, newConf.LinkUpdatePeriod)
+	if !sameIds(oldConf.ValidIspIds, newConf.ValidIspIds) || !sameIds(oldConf.ValidNationIds, newConf.ValidNationIds) ||
+		!sameIds(oldConf.CityNationIds, newConf.CityNationIds) || !sameIds(oldConf.AreaNationIds, newConf.AreaNationIds) {
+		glog.Info("valid ids or granularity of nations changed, recompute links")
+		s.triggerLinkRefresh()
+	}
+	return nil
+}
+
+// reload the config on SIGHUP, or when the config file is found modified, the
+// file is not checked when ConfigCheckPeriod is not positive
+func (s *Server) watchConfig() {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	defer signal.Stop(hupChan)
+	var lastModTime time.Time
+	if info, err := os.Stat(s.conf.ConfigFile); err == nil {
+		lastModTime = info.ModTime()
+	}
+	var checkChan <-chan time.Time
+	if s.conf.ConfigCheckPeriod > 0 {
+		checkTicker := time.NewTicker(s.conf.ConfigCheckPeriod)
+		defer checkTicker.Stop()
+		checkChan = checkTicker.C
+	}
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case <-hupChan:
+			glog.Info("reload config for SIGHUP")
+		case <-checkChan:
+			info, err := os.Stat(s.conf.ConfigFile)
+			if err != nil || !info.ModTime().After(lastModTime) {
+				continue
+			}
+			lastModTime = info.ModTime()
+			glog.Info("reload config for config file modified")
+		}
+		if err := s.reloadConfig(); err != nil {
+			glog.Errorf("reload config failed, keep the old one: %s", err.Error())
+		} else {
+			glog.Info("reload config success")
+		}
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/go-ini/ini"
+)
+
+func TestLoadReloadableConfig(t *testing.T) {
+	cfg, err := ini.Load([]byte("[server]\nvalidIspIds=1,2\nvalidNationIds=156\nlinkUpdatePeriod=30\n[cgi]\ntimeout=3\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err := loadRefreshConfig(cfg)
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	if !conf.ValidIspIds[2] || !conf.ValidNationIds[156] || len(conf.ValidIspIds) != 2 {
+		t.Errorf("unexpected valid ids %v %v", conf.ValidIspIds, conf.ValidNationIds)
+	}
+	if conf.LinkUpdatePeriod != 30*time.Second || conf.IdcUpdatePeriod != time.Hour || conf.CgiTimeout != 3*time.Second {
+		t.Errorf("unexpected periods %+v", conf)
+	}
+}
+
+func TestLoadReloadableConfigInvalid(t *testing.T) {
+	for _, content := range []string{
+		"[server]\nvalidIspIds=1,x\nvalidNationIds=156\n",
+		"[server]\nvalidIspIds=1\nvalidNationIds=\n",
+		"[server]\nvalidIspIds=1\nvalidNationIds=156\nlinkUpdatePeriod=0\n",
+		"[server]\nvalidIspIds=1\nvalidNationIds=156\n[cgi]\ntimeout=-1\n",
+	} {
+		cfg, err := ini.Load([]byte(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = loadRefreshConfig(cfg); err == nil {
+			t.Errorf("load config %q should fail", content)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	conf, err := LoadConfig("conf/server.ini")
+	if err != nil {
+		t.Fatalf("load config failed: %v", err)
+	}
+	if conf.ListenPort != 12365 || conf.DB.Port != 3306 || conf.ConfigFile != "conf/server.ini" {
+		t.Errorf("unexpected config %+v", conf)
+	}
+	// the shipped config runs no singleton job
+	if conf.Leader.Enabled || conf.Leader.PurgePeriod != 0 {
+		t.Errorf("unexpected leader config %+v", conf.Leader)
+	}
+}
+
+func TestReloadConfigRefreshLinks(t *testing.T) {
+	conf := testConfig()
+	conf.ValidIspIds = map[int64]bool{1: true}
+	conf.ConfigFile = "conf/server.ini"
+	s := newServer(conf, nil)
+	s.geoTicker = time.NewTicker(conf.GeoUpdatePeriod)
+	s.idcTicker = time.NewTicker(conf.IdcUpdatePeriod)
+	s.linkTicker = time.NewTicker(conf.LinkUpdatePeriod)
+
+	if err := s.reloadConfig(); err != nil {
+		t.Fatalf("reload config failed: %v", err)
+	}
+	if !s.refreshConfig().ValidIspIds[4] || s.refreshConfig().LinkUpdatePeriod != time.Minute {
+		t.Errorf("config is not swapped: %+v", s.refreshConfig())
+	}
+	select {
+	case <-s.linkRefreshChan:
+	default:
+		t.Error("links are not recomputed for the valid ids changed")
+	}
+	if err := s.reloadConfig(); err != nil {
+		t.Fatalf("reload config failed: %v", err)
+	}
+	select {
+	case <-s.linkRefreshChan:
+		t.Error("links are recomputed for nothing changed")
+	default:
+	}
+}
@@ -2,14 +2,27 @@ package linkdb
 
 import (
 	"common"
+	"database/sql"
 	"github.com/golang/glog"
 	"fmt"
+	"time"
 )
 
+// DB is the part of common.DBHelper used by linkdb
+type DB interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	InsertBatch(sqlPrefix, placeHold, sqlPostfix string, count int, vals ...interface{}) (int64, error)
+	Delete(query string, args ...interface{}) (int64, error)
+}
+
 
 type DnsCoverLinkIdInfo struct {
 	NationId   int64
 	ProvinceId int64
+	// 0 for a link of the whole province
+	CityId int64
+	// an area kept as a whole instead of its provinces, ProvinceId is 0 then
+	AreaId int64
 	IspId      int64
 	IdcId    int64
 }
@@ -18,32 +31,54 @@ type DnsCoverLinkIdInfo struct {
 type DnsCoverLinkNameInfo struct {
 	NationName   string `form:"nation" json:"nation" binding:"omitempty"`
 	ProvinceName string `form:"province" json:"province" binding:"required"`
+	// empty for a link of the whole province, the exception mask is always
+	// set for the whole province
+	CityName string `form:"city" json:"city,omitempty" binding:"omitempty"`
+	// the area of a link kept as a whole, the province is empty then and
+	// such a link can not be posted
+	AreaName string `form:"area" json:"area,omitempty" binding:"omitempty"`
 	IspName      string `form:"isp" json:"isp" binding:"required"`
 	IdcName      string `form:"idc_name" json:"idc_name" binding:"required"`
 }
 
 
+// NameNotFoundError is returned by TransformToNameInfo for the first dimension
+// of a link which has no name in the dictionaries
+type NameNotFoundError struct {
+	// nation, province, city, area, isp or idc
+	Dimension string
+	Id        int64
+}
+
+func (err *NameNotFoundError) Error() string {
+	return fmt.Sprintf("%s id %d has no responding %s name", err.Dimension, err.Id, err.Dimension)
+}
+
 func (linkIdInfo *DnsCoverLinkIdInfo)  TransformToNameInfo(geoInfo *common.GeoInfo, idcId2Name map[int64]string) (DnsCoverLinkNameInfo, error) {
 	var result DnsCoverLinkNameInfo
 	nationName, ok := geoInfo.NationId2Name[linkIdInfo.NationId]
 	if !ok {
-		glog.Warningf("nation id %s has no responding nation name", linkIdInfo.NationId)
-		return result, fmt.Errorf("nation id %s has no responding nation name", linkIdInfo.NationId)
+		glog.Warningf("nation id %d has no responding nation name", linkIdInfo.NationId)
+		return result, &NameNotFoundError{Dimension: "nation", Id: linkIdInfo.NationId}
 	}
-	provinceName, ok := geoInfo.ProId2Name[linkIdInfo.ProvinceId]
-	if !ok {
-		glog.Warningf("pro id %s has no responding pro name", linkIdInfo.ProvinceId)
-		return result, fmt.Errorf("pro id %s has no responding pro name", linkIdInfo.ProvinceId)
+	// the areas are not in the dictionaries, an area link has no province
+	var provinceName string
+	if linkIdInfo.AreaId == 0 {
+		provinceName, ok = geoInfo.ProId2Name[linkIdInfo.ProvinceId]
+		if !ok {
+			glog.Warningf("pro id %d has no responding pro name", linkIdInfo.ProvinceId)
+			return result, &NameNotFoundError{Dimension: "province", Id: linkIdInfo.ProvinceId}
+		}
 	}
 	ispName, ok := geoInfo.IspId2Name[linkIdInfo.IspId]
 	if !ok {
-		glog.Warningf("isp id %s has no responding isp name", linkIdInfo.IspId)
-		return result, fmt.Errorf("isp id %s has no responding isp name", linkIdInfo.IspId)
+		glog.Warningf("isp id %d has no responding isp name", linkIdInfo.IspId)
+		return result, &NameNotFoundError{Dimension: "isp", Id: linkIdInfo.IspId}
 	}
 	idcName, ok := idcId2Name[linkIdInfo.IdcId]
 	if !ok {
-		glog.Warningf("idc id %s has no responding idc name", linkIdInfo.IdcId)
-		return result, fmt.Errorf("idc id %s has no responding idc name", linkIdInfo.IdcId)
+		glog.Warningf("idc id %d has no responding idc name", linkIdInfo.IdcId)
+		return result, &NameNotFoundError{Dimension: "idc", Id: linkIdInfo.IdcId}
 	}
 	result.IdcName = idcName
 	result.IspName = ispName
@@ -92,7 +127,7 @@ type PostLinkId struct {
 	ExceptionMask int64 `json:"exception_mask"`
 }
 
-func GetConcernedClusterIds(dbHelper *common.DBHelper) (map[int64]bool, error) {
+func GetConcernedClusterIds(dbHelper DB) (map[int64]bool, error) {
 	sqlPrefix := "SELECT cluster_id FROM link_detect_cluster"
 	rows, err := dbHelper.Query(sqlPrefix)
 
@@ -112,18 +147,75 @@ func GetConcernedClusterIds(dbHelper *common.DBHelper) (map[int64]bool, error) {
 	return result, nil
 }
 
-func UpdateLinkMask(dbHelper *common.DBHelper, postLinks []PostLinkId) (int64, error) {
-	sqlPreix := "INSERT INTO link_detect_info(nation_id, province_id, isp_id, idc_id, exception_mask, ctime) VALUES"
+// UpdateLinkMask sets the masks of the links, operator is kept in updated_by,
+// see sql/001_link_detect_info_updated_by.sql
+func UpdateLinkMask(dbHelper DB, postLinks []PostLinkId, operator string) (int64, error) {
+	sqlPreix := "INSERT INTO link_detect_info(nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, ctime) VALUES"
 	var vals []interface{}
-	placeHold := "(?, ?, ?, ?, ?, NOW())"
+	placeHold := "(?, ?, ?, ?, ?, ?, NOW())"
 	for _, link := range postLinks {
-		vals = append(vals, link.NationId, link.ProvinceId, link.IspId, link.IdcId, link.ExceptionMask)
+		vals = append(vals, link.NationId, link.ProvinceId, link.IspId, link.IdcId, link.ExceptionMask, operator)
 	}
-	sqlPostfix := " ON DUPLICATE KEY UPDATE exception_mask=VALUES(exception_mask), ctime=NOW()"
+	sqlPostfix := " ON DUPLICATE KEY UPDATE exception_mask=VALUES(exception_mask), updated_by=VALUES(updated_by), ctime=NOW()"
 	return dbHelper.InsertBatch(sqlPreix, placeHold, sqlPostfix, len(postLinks), vals...)
 }
 
-func DeleteRestoredLink(dbHelper *common.DBHelper) (int64, error) {
+// GetLinkMasks returns the links with a non zero exception mask, the masks
+// are set for the whole province so CityId and AreaId are always 0
+func GetLinkMasks(dbHelper DB) (map[DnsCoverLinkIdInfo]int64, error) {
+	rows, err := dbHelper.Query("SELECT nation_id, province_id, isp_id, idc_id, exception_mask FROM link_detect_info WHERE exception_mask<>0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[DnsCoverLinkIdInfo]int64)
+	for rows.Next() {
+		var link DnsCoverLinkIdInfo
+		var mask int64
+		if err = rows.Scan(&link.NationId, &link.ProvinceId, &link.IspId, &link.IdcId, &mask); err != nil {
+			return nil, err
+		}
+		result[link] = mask
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// LinkMaskRecord is a non zero exception mask with who set it and when
+type LinkMaskRecord struct {
+	DnsCoverLinkIdInfo
+	ExceptionMask int64
+	UpdatedBy     string
+	UpdateTime    time.Time
+}
+
+// GetLinkMaskRecords returns the links with a non zero exception mask, with
+// the operator and the time of the last change
+func GetLinkMaskRecords(dbHelper DB) ([]LinkMaskRecord, error) {
+	rows, err := dbHelper.Query("SELECT nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, UNIX_TIMESTAMP(ctime) FROM link_detect_info WHERE exception_mask<>0")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var result []LinkMaskRecord
+	for rows.Next() {
+		var record LinkMaskRecord
+		var updateTime int64
+		if err = rows.Scan(&record.NationId, &record.ProvinceId, &record.IspId, &record.IdcId, &record.ExceptionMask, &record.UpdatedBy, &updateTime); err != nil {
+			return nil, err
+		}
+		record.UpdateTime = time.Unix(updateTime, 0)
+		result = append(result, record)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+func DeleteRestoredLink(dbHelper DB) (int64, error) {
 	return dbHelper.Delete("DELETE FROM link_detect_info WHERE exception_mask=0")
 }
 
@@ -132,7 +224,7 @@ type OssDb struct {
 	Slaver string
 }
 
-func GetClusterOssIps(dbHelper *common.DBHelper) ([]OssDb, error) {
+func GetClusterOssIps(dbHelper DB) ([]OssDb, error) {
 	needClusterIds, err := GetConcernedClusterIds(dbHelper)
 	if err != nil {
 		glog.Errorf("get cluster ids need has detect links failed  %s", err.Error())
@@ -1,24 +1,274 @@
 package linkdb
 
-import "common"
 import (
+	"common"
+	"errors"
+	"reflect"
+	"regexp"
 	"testing"
-	"flag"
 	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"links_manage/db_operation/dbtest"
+)
+
+func newTestDB(t *testing.T) (*dbtest.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	return newTestDBWithMatcher(t, sqlmock.QueryMatcherEqual)
+}
+
+func newTestDBWithMatcher(t *testing.T, matcher sqlmock.QueryMatcher) (*dbtest.DB, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := dbtest.NewWithMatcher(matcher)
+	if err != nil {
+		t.Fatalf("open test db failed: %v", err)
+	}
+	t.Cleanup(func() {
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Error(err)
+		}
+		db.Close()
+	})
+	return db, mock
+}
+
+func TestGetConcernedClusterIds(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").
+		WillReturnRows(sqlmock.NewRows([]string{"cluster_id"}).AddRow(1).AddRow(3))
+
+	clusterIds, err := GetConcernedClusterIds(db)
+	if err != nil {
+		t.Fatalf("get concerned cluster ids failed: %v", err)
+	}
+	if want := map[int64]bool{1: true, 3: true}; !reflect.DeepEqual(clusterIds, want) {
+		t.Errorf("got %v, want %v", clusterIds, want)
+	}
+}
+
+func TestGetConcernedClusterIdsScanError(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").
+		WillReturnRows(sqlmock.NewRows([]string{"cluster_id"}).AddRow("not a number"))
+
+	if _, err := GetConcernedClusterIds(db); err == nil {
+		t.Error("get concerned cluster ids should fail")
+	}
+}
+
+func TestGetClusterOssIps(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").
+		WillReturnRows(sqlmock.NewRows([]string{"cluster_id"}).AddRow(1).AddRow(2).AddRow(3))
+	mock.ExpectQuery("SELECT id, db, slave_db FROM cluster_info").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "db", "slave_db"}).
+			AddRow(1, "10.0.0.1", "10.0.0.2").
+			// no master, skipped
+			AddRow(2, "", "10.0.1.2").
+			AddRow(3, "10.0.2.1", "10.0.2.2").
+			// not concerned, skipped
+			AddRow(4, "10.0.3.1", "10.0.3.2"))
+
+	ossDbs, err := GetClusterOssIps(db)
+	if err != nil {
+		t.Fatalf("get cluster oss ips failed: %v", err)
+	}
+	want := []OssDb{{Master: "10.0.0.1", Slaver: "10.0.0.2"}, {Master: "10.0.2.1", Slaver: "10.0.2.2"}}
+	if !reflect.DeepEqual(ossDbs, want) {
+		t.Errorf("got %v, want %v", ossDbs, want)
+	}
+}
+
+func TestGetClusterOssIpsErrors(t *testing.T) {
+	t.Run("cluster ids", func(t *testing.T) {
+		db, mock := newTestDB(t)
+		mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").WillReturnError(errors.New("gone away"))
+		if _, err := GetClusterOssIps(db); err == nil {
+			t.Error("get cluster oss ips should fail")
+		}
+	})
+	t.Run("scan", func(t *testing.T) {
+		db, mock := newTestDB(t)
+		mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").
+			WillReturnRows(sqlmock.NewRows([]string{"cluster_id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id, db, slave_db FROM cluster_info").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "db", "slave_db"}).AddRow("x", "10.0.0.1", "10.0.0.2"))
+		if _, err := GetClusterOssIps(db); err == nil {
+			t.Error("get cluster oss ips should fail")
+		}
+	})
+	t.Run("rows", func(t *testing.T) {
+		db, mock := newTestDB(t)
+		mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").
+			WillReturnRows(sqlmock.NewRows([]string{"cluster_id"}).AddRow(1))
+		mock.ExpectQuery("SELECT id, db, slave_db FROM cluster_info").
+			WillReturnRows(sqlmock.NewRows([]string{"id", "db", "slave_db"}).
+				AddRow(1, "10.0.0.1", "10.0.0.2").
+				RowError(0, errors.New("connection reset")))
+		if _, err := GetClusterOssIps(db); err == nil {
+			t.Error("get cluster oss ips should fail")
+		}
+	})
+}
+
+// the whole upsert of UpdateLinkMask with 2 links: the key columns identify
+// the row, an existing row only gets the new mask, operator and ctime
+const updateLinkMaskSql = "INSERT INTO link_detect_info(nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, ctime) VALUES" +
+	"(?, ?, ?, ?, ?, ?, NOW()),(?, ?, ?, ?, ?, ?, NOW())" +
+	" ON DUPLICATE KEY UPDATE exception_mask=VALUES(exception_mask), updated_by=VALUES(updated_by), ctime=NOW()"
+
+func TestUpdateLinkMask(t *testing.T) {
+	db, mock := newTestDBWithMatcher(t, sqlmock.QueryMatcherRegexp)
+	links := []PostLinkId{
+		{DnsCoverLinkIdInfo: DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}, ExceptionMask: 1},
+		{DnsCoverLinkIdInfo: DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002}, ExceptionMask: 0},
+	}
+	// one new row and one updated row, mysql counts an update as 2 affected rows
+	mock.ExpectExec("^"+regexp.QuoteMeta(updateLinkMaskSql)+"$").
+		WithArgs(156, 11, 1, 1001, 1, "prober-1", 156, 44, 2, 1002, 0, "prober-1").
+		WillReturnResult(sqlmock.NewResult(0, 3))
+
+	rowCount, err := UpdateLinkMask(db, links, "prober-1")
+	if err != nil {
+		t.Fatalf("update link mask failed: %v", err)
+	}
+	if rowCount != 3 {
+		t.Errorf("got %d affected rows, want 3", rowCount)
+	}
+}
+
+func TestUpdateLinkMaskError(t *testing.T) {
+	db, mock := newTestDB(t)
+	links := []PostLinkId{
+		{DnsCoverLinkIdInfo: DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}, ExceptionMask: 1},
+	}
+	mock.ExpectExec("INSERT INTO link_detect_info(nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, ctime) VALUES" +
+		"(?, ?, ?, ?, ?, ?, NOW())" +
+		" ON DUPLICATE KEY UPDATE exception_mask=VALUES(exception_mask), updated_by=VALUES(updated_by), ctime=NOW()").
+		WillReturnError(errors.New("lock wait timeout"))
+
+	if _, err := UpdateLinkMask(db, links, "prober-1"); err == nil {
+		t.Error("update link mask should fail")
+	}
+}
+
+func TestGetLinkMasks(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectQuery("SELECT nation_id, province_id, isp_id, idc_id, exception_mask FROM link_detect_info WHERE exception_mask<>0").
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask"}).
+			AddRow(156, 11, 1, 1001, 1).
+			AddRow(156, 44, 2, 1002, 4))
+
+	masks, err := GetLinkMasks(db)
+	if err != nil {
+		t.Fatalf("get link masks failed: %v", err)
+	}
+	want := map[DnsCoverLinkIdInfo]int64{
+		{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}: 1,
+		{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002}: 4,
+	}
+	if !reflect.DeepEqual(masks, want) {
+		t.Errorf("got masks %v, want %v", masks, want)
+	}
+}
+
+func TestGetLinkMaskRecords(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectQuery("SELECT nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, UNIX_TIMESTAMP(ctime) FROM link_detect_info WHERE exception_mask<>0").
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask", "updated_by", "ctime"}).
+			AddRow(156, 11, 1, 1001, 1, "prober-1", 1700000000))
+
+	records, err := GetLinkMaskRecords(db)
+	if err != nil {
+		t.Fatalf("get link mask records failed: %v", err)
+	}
+	want := []LinkMaskRecord{{
+		DnsCoverLinkIdInfo: DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001},
+		ExceptionMask:      1,
+		UpdatedBy:          "prober-1",
+		UpdateTime:         time.Unix(1700000000, 0),
+	}}
+	if !reflect.DeepEqual(records, want) {
+		t.Errorf("got records %+v, want %+v", records, want)
+	}
+}
+
+func TestDeleteRestoredLink(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectExec("DELETE FROM link_detect_info WHERE exception_mask=0").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	rowCount, err := DeleteRestoredLink(db)
+	if err != nil {
+		t.Fatalf("delete restored link failed: %v", err)
+	}
+	if rowCount != 2 {
+		t.Errorf("got %d deleted rows, want 2", rowCount)
+	}
+}
+
+const (
+	acquireLeaseSql = "INSERT INTO link_detect_lease(name, holder, expire_time) VALUES(?, ?, NOW() + INTERVAL ? SECOND)" +
+		" ON DUPLICATE KEY UPDATE" +
+		" holder=IF(holder=VALUES(holder) OR expire_time<NOW(), VALUES(holder), holder)," +
+		" expire_time=IF(holder=VALUES(holder), VALUES(expire_time), expire_time)"
+	getLeaseSql = "SELECT holder, UNIX_TIMESTAMP(expire_time), expire_time<NOW() FROM link_detect_lease WHERE name=?"
 )
 
-var dbHelper *common.DBHelper
-func init() {
-	dbHost := flag.String("host", "127.0.0.1", "db host ip")
-	dbPort := flag.Int("port", 3306, "db port")
-	dbUser := flag.String("user", "root", "db user")
-	dbPassWord := flag.String("passwd", "root", "db passwd")
-	dbName := flag.String("db", "cdns", "db name")
-	charset := flag.String("charset", "utf8", "charset")
-	maxOpenConns := 10
-	maxIdleConns := 5
-	maxLifeTimeSeconds := time.Duration(10*time.Second)
-	flag.Parse()
-	dbHelper = common.InitDBHelper(common.NewDBConf(*dbHost, *dbName, *dbUser, *dbPassWord, *charset, *dbPort, maxOpenConns, maxIdleConns, maxLifeTimeSeconds))
+func TestAcquireLease(t *testing.T) {
+	db, mock := newTestDB(t)
+	// held by another replica, nothing changed
+	mock.ExpectExec(acquireLeaseSql).WithArgs("leader", "a:1", 30).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectQuery(getLeaseSql).WithArgs("leader").
+		WillReturnRows(sqlmock.NewRows([]string{"holder", "expire_time", "expired"}).AddRow("b:2", 1700000030, false))
+
+	lease, err := AcquireLease(db, "leader", "a:1", 30*time.Second)
+	if err != nil {
+		t.Fatalf("acquire lease failed: %v", err)
+	}
+	want := Lease{Name: "leader", Holder: "b:2", ExpireTime: time.Unix(1700000030, 0)}
+	if lease == nil || *lease != want {
+		t.Errorf("got lease %+v, want %+v", lease, want)
+	}
+}
+
+func TestGetLeaseNotTaken(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectQuery(getLeaseSql).WithArgs("leader").
+		WillReturnRows(sqlmock.NewRows([]string{"holder", "expire_time", "expired"}))
+
+	lease, err := GetLease(db, "leader")
+	if err != nil || lease != nil {
+		t.Errorf("got lease %+v, err %v, want nothing", lease, err)
+	}
 }
 
+func TestReleaseLease(t *testing.T) {
+	db, mock := newTestDB(t)
+	mock.ExpectExec("DELETE FROM link_detect_lease WHERE name=? AND holder=?").
+		WithArgs("leader", "a:1").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	if rowCount, err := ReleaseLease(db, "leader", "a:1"); err != nil || rowCount != 1 {
+		t.Errorf("release lease got %d rows, err %v", rowCount, err)
+	}
+}
+
+func TestTransformToNameInfoNotFound(t *testing.T) {
+	geoInfo := &common.GeoInfo{
+		NationId2Name: map[int64]string{156: "china"},
+		ProId2Name:    map[int64]string{11: "beijing"},
+		IspId2Name:    map[int64]string{1: "telecom"},
+	}
+	idcId2Name := map[int64]string{1001: "bj-idc-1"}
+	links := map[DnsCoverLinkIdInfo]string{
+		{NationId: 840, ProvinceId: 11, IspId: 1, IdcId: 1001}: "nation",
+		{NationId: 156, ProvinceId: 12, IspId: 1, IdcId: 1001}: "province",
+		{NationId: 156, ProvinceId: 11, IspId: 9, IdcId: 1001}: "isp",
+		{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1002}: "idc",
+	}
+	for link, dimension := range links {
+		_, err := link.TransformToNameInfo(geoInfo, idcId2Name)
+		if notFound, ok := err.(*NameNotFoundError); !ok || notFound.Dimension != dimension {
+			t.Errorf("transform %v got error %v, want %s not found", link, err, dimension)
+		}
+	}
+}
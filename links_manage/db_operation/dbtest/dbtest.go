@@ -0,0 +1,53 @@
+// Package dbtest provides an in-process stand-in of common.DBHelper for the
+// tests of linkdb and its users. The statements are checked and answered by
+// sqlmock, no mysql server is needed.
+package dbtest
+
+import (
+	"database/sql"
+	"strings"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+// DB implements linkdb.DB on top of a sqlmock connection
+type DB struct {
+	*sql.DB
+}
+
+// New returns the db and the mock to set expectations on, statements are
+// matched exactly, see sqlmock.QueryMatcherEqual
+func New() (*DB, sqlmock.Sqlmock, error) {
+	return NewWithMatcher(sqlmock.QueryMatcherEqual)
+}
+
+// NewWithMatcher is New with the statements matched by matcher
+func NewWithMatcher(matcher sqlmock.QueryMatcher) (*DB, sqlmock.Sqlmock, error) {
+	db, mock, err := sqlmock.New(sqlmock.QueryMatcherOption(matcher))
+	if err != nil {
+		return nil, nil, err
+	}
+	return &DB{DB: db}, mock, nil
+}
+
+// InsertBatch builds the statement the same way common.DBHelper does:
+// sqlPrefix, count placeHolds joined with comma, then sqlPostfix
+func (db *DB) InsertBatch(sqlPrefix, placeHold, sqlPostfix string, count int, vals ...interface{}) (int64, error) {
+	placeHolds := make([]string, count)
+	for i := range placeHolds {
+		placeHolds[i] = placeHold
+	}
+	result, err := db.Exec(sqlPrefix+strings.Join(placeHolds, ",")+sqlPostfix, vals...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (db *DB) Delete(query string, args ...interface{}) (int64, error) {
+	result, err := db.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,62 @@
+package linkdb
+
+import "time"
+
+// the leases live in link_detect_lease, created by
+// sql/002_link_detect_lease.sql. All the times are taken from the clock of mysql, so the replicas need not
+// agree on the time
+
+// Lease of a named singleton role
+type Lease struct {
+	Name       string
+	Holder     string
+	ExpireTime time.Time
+	// the holder has not renewed it in time
+	Expired bool
+}
+
+// AcquireLease takes the lease for holder when it is free, expired or already
+// held by holder, and extends it for duration. The lease after the attempt is
+// returned, holder is the leader only if it is the Holder of the result.
+func AcquireLease(dbHelper DB, name, holder string, duration time.Duration) (*Lease, error) {
+	sqlPrefix := "INSERT INTO link_detect_lease(name, holder, expire_time) VALUES"
+	placeHold := "(?, ?, NOW() + INTERVAL ? SECOND)"
+	// holder is assigned first, so expire_time is only extended when holder
+	// owns the lease after the update
+	sqlPostfix := " ON DUPLICATE KEY UPDATE" +
+		" holder=IF(holder=VALUES(holder) OR expire_time<NOW(), VALUES(holder), holder)," +
+		" expire_time=IF(holder=VALUES(holder), VALUES(expire_time), expire_time)"
+	seconds := int64(duration / time.Second)
+	if _, err := dbHelper.InsertBatch(sqlPrefix, placeHold, sqlPostfix, 1, name, holder, seconds); err != nil {
+		return nil, err
+	}
+	return GetLease(dbHelper, name)
+}
+
+// GetLease returns nil when the lease was never taken
+func GetLease(dbHelper DB, name string) (*Lease, error) {
+	rows, err := dbHelper.Query("SELECT holder, UNIX_TIMESTAMP(expire_time), expire_time<NOW() FROM link_detect_lease WHERE name=?", name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	if !rows.Next() {
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	lease := Lease{Name: name}
+	var expireTime int64
+	if err = rows.Scan(&lease.Holder, &expireTime, &lease.Expired); err != nil {
+		return nil, err
+	}
+	lease.ExpireTime = time.Unix(expireTime, 0)
+	return &lease, nil
+}
+
+// ReleaseLease gives up the lease if it is still held by holder, so another
+// replica takes over without waiting for it to expire
+func ReleaseLease(dbHelper DB, name, holder string) (int64, error) {
+	return dbHelper.Delete("DELETE FROM link_detect_lease WHERE name=? AND holder=?", name, holder)
+}
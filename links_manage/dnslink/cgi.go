@@ -0,0 +1,58 @@
+package dnslink
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type cgiResponse interface {
+	GetErrno() int64
+	GetError() string
+}
+
+// same as common.GetJsonResponseFromCgi, but the request is aborted once ctx is done
+func getJsonResponseFromCgi(ctx context.Context, url string, timeout time.Duration, resp cgiResponse) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	httpResp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cgi %s return http status %d", url, httpResp.StatusCode)
+	}
+	if err = json.NewDecoder(httpResp.Body).Decode(resp); err != nil {
+		return fmt.Errorf("decode cgi %s response failed: %s", url, err.Error())
+	}
+	if resp.GetErrno() != 0 {
+		return fmt.Errorf("cgi %s return errno %d: %s", url, resp.GetErrno(), resp.GetError())
+	}
+	return nil
+}
+
+// run fn aside and stop waiting once ctx is done. it is for the calls of common
+// which can not be cancelled, they end on their own timeout. fn must only
+// write its own results, which are valid only when nil is returned.
+func runWithContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		return err
+	}
+}
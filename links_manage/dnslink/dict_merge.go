@@ -0,0 +1,208 @@
+package dnslink
+
+import (
+	"common"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	. "links_manage/db_operation"
+	"sort"
+	"strconv"
+)
+
+// DictConflict is an id with different names, or a name with different ids,
+// among the clusters. The merged dictionary keeps the value of the first
+// cluster in the order of the oss dbs.
+type DictConflict struct {
+	// nation, province, isp or idc
+	Dict string `json:"dict"`
+	// the id with different names, or zero
+	Id int64 `json:"id,omitempty"`
+	// the name with different ids, or empty
+	Name string `json:"name,omitempty"`
+	// the different names or ids to the oss ips giving them
+	Values map[string][]string `json:"values"`
+}
+
+func (conflict *DictConflict) String() string {
+	if conflict.Name != "" {
+		return fmt.Sprintf("%s name %s has ids %v", conflict.Dict, conflict.Name, conflict.Values)
+	}
+	return fmt.Sprintf("%s id %d has names %v", conflict.Dict, conflict.Id, conflict.Values)
+}
+
+// dictMerger merges the id name pairs of a dictionary from the clusters, the
+// first value seen wins
+type dictMerger struct {
+	dict    string
+	id2Name map[int64]string
+	name2Id map[string]int64
+	// all the values seen with their oss ips
+	id2Names map[int64]map[string][]string
+	name2Ids map[string]map[int64][]string
+}
+
+func newDictMerger(dict string) *dictMerger {
+	return &dictMerger{
+		dict:     dict,
+		id2Name:  make(map[int64]string),
+		name2Id:  make(map[string]int64),
+		id2Names: make(map[int64]map[string][]string),
+		name2Ids: make(map[string]map[int64][]string),
+	}
+}
+
+func (m *dictMerger) add(id int64, name, ossIp string) {
+	if _, ok := m.id2Name[id]; !ok {
+		m.id2Name[id] = name
+	}
+	if _, ok := m.name2Id[name]; !ok {
+		m.name2Id[name] = id
+	}
+	if m.id2Names[id] == nil {
+		m.id2Names[id] = make(map[string][]string)
+	}
+	m.id2Names[id][name] = append(m.id2Names[id][name], ossIp)
+	if m.name2Ids[name] == nil {
+		m.name2Ids[name] = make(map[int64][]string)
+	}
+	m.name2Ids[name][id] = append(m.name2Ids[name][id], ossIp)
+}
+
+// add the pairs in the order of id, so the same name of two ids in a cluster
+// is always resolved to the smaller id
+func (m *dictMerger) addAll(id2Name map[int64]string, ossIp string) {
+	ids := make([]int64, 0, len(id2Name))
+	for id := range id2Name {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		m.add(id, id2Name[id], ossIp)
+	}
+}
+
+// conflicts sorted by id then by name
+func (m *dictMerger) conflicts() []DictConflict {
+	var result []DictConflict
+	var ids []int64
+	for id, names := range m.id2Names {
+		if len(names) > 1 {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		result = append(result, DictConflict{Dict: m.dict, Id: id, Values: m.id2Names[id]})
+	}
+	var names []string
+	for name, ids := range m.name2Ids {
+		if len(ids) > 1 {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := make(map[string][]string)
+		for id, ossIps := range m.name2Ids[name] {
+			values[strconv.FormatInt(id, 10)] = ossIps
+		}
+		result = append(result, DictConflict{Dict: m.dict, Name: name, Values: values})
+	}
+	return result
+}
+
+// fetch something from every cluster, trying the slave when the master
+// failed. fetch is called with the index of the cluster in ossDbs. The
+// masters of the clusters which did not answer are returned, the fetch only
+// fails when no cluster answered or ctx is done.
+func fetchFromAllClusters(ctx context.Context, ossDbs []OssDb, fetch func(ctx context.Context, i int, ossIp string) error) ([]string, error) {
+	errs := make([]error, len(ossDbs))
+	errChan := make(chan error, len(ossDbs))
+	for i, ossIps := range ossDbs {
+		go func(i int, ossIpPair OssDb) {
+			var err error
+			for _, ossIp := range []string{ossIpPair.Master, ossIpPair.Slaver} {
+				if ctx.Err() != nil {
+					break
+				}
+				if err = fetch(ctx, i, ossIp); err == nil {
+					break
+				}
+				glog.Errorf("fetch from oss %s failed: %s", ossIp, err.Error())
+			}
+			if ctx.Err() != nil {
+				err = ctx.Err()
+			}
+			errs[i] = err
+			errChan <- err
+		}(i, ossIps)
+	}
+	for range ossDbs {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-errChan:
+		}
+	}
+	var missing []string
+	var lastErr error
+	for i, err := range errs {
+		if err != nil {
+			glog.Errorf("fetch from both oss of cluster %s failed: %s", ossDbs[i].Master, err.Error())
+			missing = append(missing, ossDbs[i].Master)
+			lastErr = err
+		}
+	}
+	if len(ossDbs) > 0 && len(missing) == len(ossDbs) {
+		return nil, fmt.Errorf("fetch from all the clusters failed: %s", lastErr.Error())
+	}
+	return missing, nil
+}
+
+// LoadGeoInfoMap merges the geo info of the clusters which answered, the
+// conflicts are logged and returned with the masters of the clusters missing
+func LoadGeoInfoMap(ctx context.Context, src OssSource, ossDbs []OssDb) (*common.GeoInfo, []DictConflict, []string, error) {
+	geoInfos := make([]*common.GeoInfo, len(ossDbs))
+	ossIps := make([]string, len(ossDbs))
+	missing, err := fetchFromAllClusters(ctx, ossDbs, func(ctx context.Context, i int, ossIp string) error {
+		geoInfo, err := src.GetGeoInfo(ctx, ossIp)
+		if err != nil {
+			return err
+		}
+		geoInfos[i], ossIps[i] = geoInfo, ossIp
+		return nil
+	})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	nations, provinces, isps := newDictMerger("nation"), newDictMerger("province"), newDictMerger("isp")
+	for i, geoInfo := range geoInfos {
+		if geoInfo == nil {
+			continue
+		}
+		nations.addAll(geoInfo.NationId2Name, ossIps[i])
+		provinces.addAll(geoInfo.ProId2Name, ossIps[i])
+		isps.addAll(geoInfo.IspId2Name, ossIps[i])
+	}
+	result := &common.GeoInfo{
+		NationId2Name: nations.id2Name,
+		NationName2Id: nations.name2Id,
+		ProId2Name:    provinces.id2Name,
+		ProName2Id:    provinces.name2Id,
+		IspId2Name:    isps.id2Name,
+		IspName2Id:    isps.name2Id,
+	}
+	var conflicts []DictConflict
+	for _, m := range []*dictMerger{nations, provinces, isps} {
+		conflicts = append(conflicts, m.conflicts()...)
+	}
+	logConflicts(conflicts)
+	return result, conflicts, missing, nil
+}
+
+func logConflicts(conflicts []DictConflict) {
+	for i := range conflicts {
+		glog.Warningf("dictionary conflict: %s", conflicts[i].String())
+	}
+}
@@ -0,0 +1,93 @@
+package dnslink
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+
+	. "links_manage/db_operation"
+	"links_manage/dnslink/osstest"
+)
+
+// a second cluster which knows guangxi, calls 1002 by another name and gives
+// bj-idc-1 another id
+func startSecondCluster() *osstest.Server {
+	oss := osstest.NewDefaultServer()
+	oss.SetFixture("basic_info.json", `{"errno": 0, "error": "", "seq": 1, "data": {
+		"nation": [{"id": 156, "name": "china"}],
+		"province": [{"id": 11, "name": "beijing", "area_id": "1"}, {"id": 45, "name": "guangxi", "area_id": "2"}],
+		"isp": [{"id": 1, "name": "telecom"}, {"id": 5, "name": "telecom"}]}}`)
+	oss.SetFixture("idc_query.json", `{"errno": 0, "error": "", "seq": 1, "data": [
+		{"id": 1002, "idcName": "gz-idc-2"},
+		{"id": 1003, "idcName": "sh-idc-1"},
+		{"id": 1004, "idcName": "bj-idc-1"}]}`)
+	return oss
+}
+
+func TestLoadIdcInfoMapConflicts(t *testing.T) {
+	first := osstest.NewDefaultServer()
+	defer first.Close()
+	second := startSecondCluster()
+	defer second.Close()
+
+	src := NewCgiSource("test", 2*time.Second)
+	ossDbs := []OssDb{{Master: first.Addr, Slaver: first.Addr}, {Master: second.Addr, Slaver: second.Addr}}
+	idcInfo, conflicts, missing, err := LoadIdcInfoMapFromCgi(context.Background(), src, ossDbs)
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("load idc info failed: %v, missing %v", err, missing)
+	}
+	// the first cluster wins
+	wantId2Name := map[int64]string{1001: "bj-idc-1", 1002: "gz-idc-1", 1003: "sh-idc-1", 1004: "bj-idc-1"}
+	if !reflect.DeepEqual(idcInfo.IdcId2Name, wantId2Name) {
+		t.Errorf("got idc names %v, want %v", idcInfo.IdcId2Name, wantId2Name)
+	}
+	if idcInfo.IdcName2Id["bj-idc-1"] != 1001 || idcInfo.IdcName2Id["gz-idc-2"] != 1002 {
+		t.Errorf("unexpected idc ids %v", idcInfo.IdcName2Id)
+	}
+	wantConflicts := []DictConflict{
+		{Dict: "idc", Id: 1002, Values: map[string][]string{"gz-idc-1": {first.Addr}, "gz-idc-2": {second.Addr}}},
+		{Dict: "idc", Name: "bj-idc-1", Values: map[string][]string{"1001": {first.Addr}, "1004": {second.Addr}}},
+	}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("got conflicts %v, want %v", conflicts, wantConflicts)
+	}
+}
+
+func TestLoadGeoInfoMap(t *testing.T) {
+	first := osstest.NewDefaultServer()
+	defer first.Close()
+	second := startSecondCluster()
+	defer second.Close()
+
+	src := NewCgiSource("test", 2*time.Second)
+	ossDbs := []OssDb{{Master: first.Addr, Slaver: first.Addr}, {Master: second.Addr, Slaver: second.Addr}}
+	geoInfo, conflicts, missing, err := LoadGeoInfoMap(context.Background(), src, ossDbs)
+	if err != nil || len(missing) != 0 {
+		t.Fatalf("load geo info failed: %v, missing %v", err, missing)
+	}
+	if geoInfo.ProId2Name[45] != "guangxi" || geoInfo.ProId2Name[44] != "guangdong" || geoInfo.IspName2Id["telecom"] != 1 {
+		t.Errorf("unexpected geo info %+v", geoInfo)
+	}
+	wantConflicts := []DictConflict{
+		{Dict: "isp", Name: "telecom", Values: map[string][]string{"1": {first.Addr, second.Addr}, "5": {second.Addr}}},
+	}
+	if !reflect.DeepEqual(conflicts, wantConflicts) {
+		t.Errorf("got conflicts %v, want %v", conflicts, wantConflicts)
+	}
+
+	// a cluster without geo info is left out and reported
+	second.SetFault(osstest.BasicInfoCgi, osstest.Fault{Errno: 1})
+	geoInfo, _, missing, err = LoadGeoInfoMap(context.Background(), src, ossDbs)
+	if err != nil {
+		t.Fatalf("load geo info failed: %v", err)
+	}
+	if !reflect.DeepEqual(missing, []string{second.Addr}) || geoInfo.ProId2Name[44] != "guangdong" || geoInfo.ProId2Name[45] != "" {
+		t.Errorf("unexpected geo info %+v, missing %v", geoInfo, missing)
+	}
+	// the load fails only when no cluster answered
+	first.SetFault(osstest.BasicInfoCgi, osstest.Fault{Errno: 1})
+	if _, _, _, err = LoadGeoInfoMap(context.Background(), src, ossDbs); err == nil {
+		t.Error("load geo info should fail")
+	}
+}
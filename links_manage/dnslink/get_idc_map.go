@@ -1,11 +1,11 @@
 package dnslink
 
 import (
+	"context"
 	"time"
 	"github.com/golang/glog"
 	"common"
 	. "links_manage/db_operation"
-	"fmt"
 )
 
 type IdcIdNameMap struct {
@@ -23,9 +23,9 @@ type IdcIdNameResponse struct {
 	Data []IdcIdName `json:"data"`
 }
 
-func GetClusterIdcInfoFromCgi(url string, timeout time.Duration) (*IdcIdNameResponse, error) {
+func GetClusterIdcInfoFromCgi(ctx context.Context, url string, timeout time.Duration) (*IdcIdNameResponse, error) {
 	var idcResp IdcIdNameResponse
-	err := common.GetJsonResponseFromCgi(url, timeout, &idcResp)
+	err := getJsonResponseFromCgi(ctx, url, timeout, &idcResp)
 	if err != nil {
 		glog.Errorf("get cluster idc info from %s failed", url)
 		return nil, err
@@ -33,53 +33,30 @@ func GetClusterIdcInfoFromCgi(url string, timeout time.Duration) (*IdcIdNameResp
 	return &idcResp, nil
 }
 
-type IdcRespWithError struct {
-	idcResp *IdcIdNameResponse
-	err error
-}
-
-// merge all idc info of cluster
-func LoadIdcInfoMapFromCgi(dbHelper *common.DBHelper, urlFormat string, timeout time.Duration) (*IdcIdNameMap, error) {
-	ossDbs, err := GetClusterOssIps(dbHelper)
+// merge the idc info of the clusters which answered, the conflicts are logged
+// and returned with the masters of the clusters missing
+func LoadIdcInfoMapFromCgi(ctx context.Context, src OssSource, ossDbs []OssDb) (*IdcIdNameMap, []DictConflict, []string, error) {
+	clusterIdcs := make([][]IdcIdName, len(ossDbs))
+	ossIps := make([]string, len(ossDbs))
+	missing, err := fetchFromAllClusters(ctx, ossDbs, func(ctx context.Context, i int, ossIp string) error {
+		idcs, err := src.GetIdcs(ctx, ossIp)
+		if err != nil {
+			return err
+		}
+		clusterIdcs[i], ossIps[i] = idcs, ossIp
+		return nil
+	})
 	if err != nil {
-		glog.Fatal("get cluster oss ip failed")
-		return nil, fmt.Errorf("get cluster oss ip failed")
-	}
-	var idcInfo IdcIdNameMap
-	dataChan := make(chan IdcRespWithError, len(ossDbs))
-	for _, ossIps := range ossDbs {
-		go func(ossIpPair OssDb) {
-			clusterOssIps := []string{ossIpPair.Master, ossIpPair.Slaver}
-			succFlag := false
-			for _, cip := range clusterOssIps {
-				url := fmt.Sprintf(urlFormat, cip)
-				idcResp, err := GetClusterIdcInfoFromCgi(url, timeout)
-				if err == nil {
-					dataChan <- IdcRespWithError{idcResp:idcResp, err:nil}
-					succFlag = true
-					break
-				} else {
-					glog.Errorf("get cluster idc info from oss %s failed", cip)
-				}
-			}
-			if !succFlag {
-				glog.Error("get cluster idc failed from both oss ip")
-				dataChan <- IdcRespWithError{idcResp:nil, err:fmt.Errorf("get cluster idc failed")}
-			}
-		}(ossIps)
+		glog.Errorf("get cluster idc failed: %s", err.Error())
+		return nil, nil, nil, err
 	}
-	idcInfo.IdcName2Id = make(map[string]int64)
-	idcInfo.IdcId2Name = make(map[int64]string)
-	for range ossDbs {
-		idcItem := <-dataChan
-		if idcItem.err != nil {
-			return nil, err
-		} else {
-			for _, idc := range idcItem.idcResp.Data {
-				idcInfo.IdcId2Name[idc.Id] = idc.Name
-				idcInfo.IdcName2Id[idc.Name] = idc.Id
-			}
+	merger := newDictMerger("idc")
+	for i, idcs := range clusterIdcs {
+		for _, idc := range idcs {
+			merger.add(idc.Id, idc.Name, ossIps[i])
 		}
 	}
-	return &idcInfo, nil
+	conflicts := merger.conflicts()
+	logConflicts(conflicts)
+	return &IdcIdNameMap{IdcId2Name: merger.id2Name, IdcName2Id: merger.name2Id}, conflicts, missing, nil
 }
@@ -2,10 +2,13 @@ package dnslink
 
 import (
 	"common"
+	"context"
 	"fmt"
 	"github.com/golang/glog"
+	"math"
 	"time"
 	"strconv"
+	"strings"
 	. "links_manage/db_operation"
 )
 
@@ -69,133 +72,222 @@ func (res *DnsCoverInfoResponse) GetError() string {
 	return res.Error
 }
 
+// load geo info, give up waiting once ctx is done
+func LoadGeoInfoFromCgi(ctx context.Context, url string, timeout time.Duration) (*common.GeoInfo, error) {
+	var geoInfo *common.GeoInfo
+	err := runWithContext(ctx, func() error {
+		var err error
+		geoInfo, err = common.LoadGeoInfo(url, timeout)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return geoInfo, nil
+}
+
 // get areaid to proids map
-func getAreaId2ProIds(url string, timeout time.Duration) (map[int64][]int64, error) {
-	geoResp, err := common.GetClusterGeoInfoByCgi(url, timeout)
+func getAreaId2ProIds(ctx context.Context, url string, timeout time.Duration) (map[int64][]int64, error) {
+	areaId2ProIds := make(map[int64][]int64)
+	err := runWithContext(ctx, func() error {
+		geoResp, err := common.GetClusterGeoInfoByCgi(url, timeout)
+		if err != nil {
+			return err
+		}
+		for _, proInfo := range geoResp.Data.Province {
+			areaId, err := strconv.ParseInt(proInfo.AreaIdString, 10, 64)
+			if err == nil {
+				areaId2ProIds[areaId] = append(areaId2ProIds[areaId], proInfo.Id)
+			}
+		}
+		return nil
+	})
 	if err != nil {
 		glog.Errorf("get cluster geo info from %s failed", url)
 		return nil,  err
 	}
-	areaId2ProIds := make(map[int64][]int64)
-	for _, proInfo := range geoResp.Data.Province {
-		areaId, err := strconv.ParseInt(proInfo.AreaIdString, 10, 64)
-		if err == nil {
-			areaId2ProIds[areaId] = append(areaId2ProIds[areaId], proInfo.Id)
+	return areaId2ProIds, nil
+}
+
+func enabledIps(idcIps []IdcIp) []LinkIp {
+	var result []LinkIp
+	for _, idcIp := range idcIps {
+		if idcIp.Enabled != 0 {
+			result = append(result, LinkIp{Ip: idcIp.Ip, Vip: idcIp.Vip, Type: idcIp.IpType, Inner: idcIp.InnerIp != 0})
 		}
 	}
-	return areaId2ProIds, nil
+	return result
 }
 
-// for every domain for res-id
-func getDnsCoverLinks(url string, timeout time.Duration, areaId2ProIds map[int64][]int64) (map[DnsCoverLinkIdInfo]bool, error) {
-	var respJson DnsCoverInfoResponse
-	err := common.GetJsonResponseFromCgi(url, timeout, &respJson)
+// for every domain for res-id, with how the covers of an area are expanded
+func getDnsCoverLinks(ctx context.Context, src OssSource, clusterOssIp string, resId int64, areaId2ProIds map[int64][]int64, opts *LinkOptions) (Links, []AreaExpansion, error) {
+	coverInfos, err := src.GetCoverInfo(ctx, clusterOssIp, resId)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	result := make(map[DnsCoverLinkIdInfo]bool)
-	for _, resData := range respJson.Data {
+	result := make(Links)
+	var areas []AreaExpansion
+	for _, resData := range coverInfos {
 		for _, dnsCover := range resData.DetailCover {
 			// cover with province
 			var proIds []int64
+			var areaId int64
 			if dnsCover.AreaId < 0 {
 				proIds = append(proIds, -dnsCover.AreaId)
 			} else {
+				expansion := AreaExpansion{OssIp: clusterOssIp, AreaId: dnsCover.AreaId, AreaName: dnsCover.AreaName, Covers: 1}
 				var ok bool
-				proIds, ok = areaId2ProIds[dnsCover.AreaId]
-				if !ok {
+				expansion.ProvinceIds, ok = areaId2ProIds[dnsCover.AreaId]
+				switch {
+				case opts.AreaNationIds[dnsCover.NationId]:
+					// the link of the area has no province
+					expansion.Mode = AreaModeKept
+					areaId = dnsCover.AreaId
+					proIds = []int64{0}
+				case ok:
+					expansion.Mode = AreaModeProvinces
+					proIds = expansion.ProvinceIds
+				default:
+					expansion.Mode = AreaModeUnknown
 					glog.Warningf("area id :%d not in areaid2proid map", dnsCover.AreaId)
+				}
+				areas = append(areas, expansion)
+				if expansion.Mode == AreaModeUnknown {
 					continue
 				}
 			}
+			source := LinkSource{
+				OssIp:        clusterOssIp,
+				ResId:        resData.ResId,
+				ResGroupId:   dnsCover.ResGroupId,
+				ResGroupName: dnsCover.ResGroupName,
+				ResGroupType: dnsCover.ResGroupType,
+				AreaId:       dnsCover.AreaId,
+				AreaExpanded: dnsCover.AreaId >= 0 && areaId == 0,
+				Priority:     dnsCover.Priority,
+			}
+			// ParseFloat takes NaN and Inf, and gives an Inf for a number out
+			// of range, none of them adds up to a weight
+			if source.Weight, err = strconv.ParseFloat(strings.TrimSpace(dnsCover.Weight), 64); err != nil || math.IsNaN(source.Weight) || math.IsInf(source.Weight, 0) {
+				glog.Warningf("weight %q of resgrp %d of res %d from %s is not a number", dnsCover.Weight, dnsCover.ResGroupId, resData.ResId, clusterOssIp)
+				source.Weight = 0
+				source.WeightError = true
+				source.BadWeight = dnsCover.Weight
+			}
+			// only a cover of a province is split by city, the city of an
+			// area cover is not in all the provinces of the area
+			var cityId int64
+			if dnsCover.AreaId < 0 && opts.CityNationIds[dnsCover.NationId] {
+				cityId = dnsCover.CityId
+			}
 			for _, proName := range proIds {
 				for _, idc := range dnsCover.Idcs {
-					link := DnsCoverLinkIdInfo{IspId: dnsCover.IspId, NationId: dnsCover.NationId, IdcId: idc.IdcId, ProvinceId: proName}
-					result[link] = true
+					link := DnsCoverLinkIdInfo{IspId: dnsCover.IspId, NationId: dnsCover.NationId, IdcId: idc.IdcId, ProvinceId: proName, CityId: cityId, AreaId: areaId}
+					result.add(link, source, enabledIps(idc.Ips))
+					if cityId != 0 {
+						result[link].CityName = dnsCover.CityName
+					}
+					if areaId != 0 {
+						result[link].AreaName = dnsCover.AreaName
+					}
 				}
 			}
 		}
 	}
-	return result, nil
+	return result, areas, nil
 }
 
 type LinkItem struct {
-	links map[DnsCoverLinkIdInfo]bool
+	links Links
+	areas []AreaExpansion
 	err error
 }
 
-func getClusterAllLinks(clusterOssIp string, timeout time.Duration, validIspIds , validNationIds map[int64]bool) (map[DnsCoverLinkIdInfo]bool, error) {
-	resUrl := fmt.Sprintf("http://%s/cgi-bin/tars_oss/cgi-bin/get_zone_info_int.cgi?user=cloudywu", clusterOssIp)
-	resIds, err := getResIds(resUrl, timeout)
-	result := make(map[DnsCoverLinkIdInfo]bool)
+func getClusterAllLinks(ctx context.Context, src OssSource, clusterOssIp string, opts *LinkOptions) (Links, []AreaExpansion, error) {
+	resIds, err := src.GetResIds(ctx, clusterOssIp)
+	result := make(Links)
+	var areas []AreaExpansion
 	if err != nil {
-		glog.Errorf("get res-id from %s failed", resUrl)
-		return nil, err
+		glog.Errorf("get res-id from %s failed", clusterOssIp)
+		return nil, nil, err
 	} else {
-		geoUrl := fmt.Sprintf("http://%s/cgi-bin/tars_oss/cgi-bin/get_cdns_basic_info_int.cgi?info_type=province&user=cloudywu", clusterOssIp)
-		areaId2ProIds,  err := getAreaId2ProIds(geoUrl, timeout)
+		areaId2ProIds,  err := src.GetAreaId2ProIds(ctx, clusterOssIp)
 		if err != nil {
-			glog.Errorf("get geo info from %s failed", geoUrl)
-			return nil, err
+			glog.Errorf("get geo info from %s failed", clusterOssIp)
+			return nil, nil, err
 		}
+		// stop the other res once one failed
+		ctx, cancel := context.WithCancel(ctx)
+		defer cancel()
 		linkChan := make(chan LinkItem, len(resIds))
 		for resId := range resIds {
 			go func(resId int64) {
-				coverUrl := fmt.Sprintf("http://%s/cgi-bin/tars_oss/cgi-bin/get_res_cover_info_int.cgi?user=cloudywu&charip=1&res_id=%d", clusterOssIp, resId)
 				var it LinkItem
-				it.links, it.err = getDnsCoverLinks(coverUrl, timeout, areaId2ProIds)
+				it.links, it.areas, it.err = getDnsCoverLinks(ctx, src, clusterOssIp, resId, areaId2ProIds, opts)
 				linkChan <- it
 			}(resId)
 		}
 		for range resIds {
-			linkItem := <-linkChan
+			var linkItem LinkItem
+			select {
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			case linkItem = <-linkChan:
+			}
 			if linkItem.err != nil {
-				return nil, fmt.Errorf("get cover failed form some res")
+				return nil, nil, fmt.Errorf("get cover failed form some res")
 			} else {
-				for link := range linkItem.links {
-					if validIspIds[link.IspId] && validNationIds[link.NationId] {
-						result[link] = true
+				for link, detail := range linkItem.links {
+					if opts.valid(link) {
+						result.merge(link, detail)
 					}
 				}
+				areas = append(areas, linkItem.areas...)
 			}
 		}
 	}
-	return result, nil
+	return result, areas, nil
 }
 
 
-func GetAllLinks(dbHelper *common.DBHelper, timeout time.Duration, validIspIds , validNationIds map[int64]bool) (map[DnsCoverLinkIdInfo]bool,  error) {
-	ossIps, err :=	GetClusterOssIps(dbHelper)
-	if err != nil {
-		glog.Error("get cluster oss ip info failed")
-		return nil, err
-	}
-	result := make(map[DnsCoverLinkIdInfo]bool)
+// GetAllLinks of all the clusters selected by opts, with the cover entries
+// producing each link and how the areas of every cluster are expanded
+func GetAllLinks(ctx context.Context, src OssSource, ossIps []OssDb, opts LinkOptions) (Links, []AreaExpansion, error) {
+	// stop the other clusters once one failed
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	result := make(Links)
+	var areas []AreaExpansion
 	dataChan := make(chan LinkItem, len(ossIps))
 	for _, ossIpInfo := range ossIps {
 		go func(ossIpInfo OssDb) {
-			links, err := getClusterAllLinks(ossIpInfo.Master, timeout, validIspIds , validNationIds)
+			links, clusterAreas, err := getClusterAllLinks(ctx, src, ossIpInfo.Master, &opts)
+			if err != nil && ctx.Err() == nil {
+				 links, clusterAreas, err = getClusterAllLinks(ctx, src, ossIpInfo.Slaver, &opts)
+			}
 			if err != nil {
-				 links, err = getClusterAllLinks(ossIpInfo.Slaver, timeout, validIspIds , validNationIds)
-				if err != nil {
-					glog.Errorf("get cluster link failed for master: %s, slave:%s", ossIpInfo.Master, ossIpInfo.Slaver)
-					dataChan <- LinkItem{links:nil, err:err}
-				} else {
-					dataChan <- LinkItem{links: links, err: nil}
-				}
+				glog.Errorf("get cluster link failed for master: %s, slave:%s", ossIpInfo.Master, ossIpInfo.Slaver)
+				dataChan <- LinkItem{links:nil, err:err}
 			} else {
-				dataChan <- LinkItem{links:links, err:nil}
+				dataChan <- LinkItem{links:links, areas:clusterAreas, err:nil}
 			}
 		}(ossIpInfo)
 	}
 	for range ossIps {
-		linkData := <-dataChan
+		var linkData LinkItem
+		select {
+		case <-ctx.Done():
+			return nil, nil, ctx.Err()
+		case linkData = <-dataChan:
+		}
 		if linkData.err != nil {
-			return nil, fmt.Errorf("get links failed for some cluster")
+			return nil, nil, fmt.Errorf("get links failed for some cluster")
 		}
-		for link := range linkData.links {
-			result[link] = true
+		for link, detail := range linkData.links {
+			result.merge(link, detail)
 		}
+		areas = append(areas, linkData.areas...)
 	}
-	return result, nil
+	result.finish()
+	return result, mergeAreaExpansions(areas), nil
 }
@@ -0,0 +1,320 @@
+package dnslink
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	. "links_manage/db_operation"
+	"links_manage/dnslink/osstest"
+)
+
+var testLinkOptions = LinkOptions{
+	ValidIspIds:    map[int64]bool{1: true, 2: true, 4: true},
+	ValidNationIds: map[int64]bool{156: true},
+}
+
+// links of the fixtures of osstest with the valid ids above
+var testLinks = map[DnsCoverLinkIdInfo]bool{
+	{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}: true,
+	{NationId: 156, ProvinceId: 12, IspId: 1, IdcId: 1001}: true,
+	{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002}: true,
+	{NationId: 156, ProvinceId: 11, IspId: 4, IdcId: 1001}: true,
+	{NationId: 156, ProvinceId: 11, IspId: 4, IdcId: 1002}: true,
+}
+
+func checkLinks(t *testing.T, links Links) {
+	t.Helper()
+	if len(links) != len(testLinks) {
+		t.Errorf("got %d links, want %d: %v", len(links), len(testLinks), links)
+	}
+	for link := range testLinks {
+		if links[link] == nil {
+			t.Errorf("link %v is missing", link)
+		}
+	}
+}
+
+func TestGetAllLinks(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+
+	src := NewCgiSource("test", 2*time.Second)
+	links, _, err := GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, testLinkOptions)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	checkLinks(t, links)
+
+	sources := map[DnsCoverLinkIdInfo][]LinkSource{
+		{NationId: 156, ProvinceId: 12, IspId: 1, IdcId: 1001}: {
+			{OssIp: oss.Addr, ResId: 101, ResGroupId: 11, ResGroupName: "north-telecom", ResGroupType: 1, AreaId: 1, AreaExpanded: true, Priority: 1, Weight: 100},
+		},
+		{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002}: {
+			{OssIp: oss.Addr, ResId: 101, ResGroupId: 12, ResGroupName: "gd-unicom", ResGroupType: 2, AreaId: -44, Priority: 2, Weight: 50},
+		},
+	}
+	for link, want := range sources {
+		if got := links[link]; got == nil || !reflect.DeepEqual(got.Sources, want) {
+			t.Errorf("link %v got detail %+v, want sources %+v", link, got, want)
+		}
+	}
+}
+
+func TestGetAllLinksPriorityWeight(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	// beijing telecom is also covered by res 102, beijing mobile has a
+	// weight which is not a number and tianjin unicom has no weight, guangdong
+	// telecom, guangdong mobile and tianjin mobile have a weight which parses
+	// but is not a finite number
+	oss.SetFixture("res_cover_102.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"res_id": 102, "cover": [
+		{"area_id": -11, "isp_id": 1, "nation_id": 156, "priority": 3, "resgrp_id": 24, "weight": " 20 ",
+			"idcs": [{"idc_id": 1001, "ips": []}]},
+		{"area_id": -11, "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 21, "weight": "heavy",
+			"idcs": [{"idc_id": 1001, "ips": []}]},
+		{"area_id": -12, "isp_id": 2, "nation_id": 156, "priority": 1, "resgrp_id": 22, "weight": "",
+			"idcs": [{"idc_id": 1001, "ips": []}]},
+		{"area_id": -44, "isp_id": 1, "nation_id": 156, "priority": 1, "resgrp_id": 26, "weight": "NaN",
+			"idcs": [{"idc_id": 1002, "ips": []}]},
+		{"area_id": -44, "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 27, "weight": "1e400",
+			"idcs": [{"idc_id": 1002, "ips": []}]},
+		{"area_id": -12, "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 28, "weight": "-Inf",
+			"idcs": [{"idc_id": 1001, "ips": []}]}]}]}`)
+
+	src := NewCgiSource("test", 2*time.Second)
+	links, _, err := GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, testLinkOptions)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	telecom := links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}]
+	if telecom == nil || telecom.Priority != 1 || telecom.Weight != 120 || len(telecom.Sources) != 2 {
+		t.Errorf("unexpected beijing telecom detail %+v", telecom)
+	}
+	mobile := links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 4, IdcId: 1001}]
+	if mobile == nil || mobile.Weight != 0 || len(mobile.Sources) != 1 || !mobile.Sources[0].WeightError || mobile.Sources[0].BadWeight != "heavy" {
+		t.Errorf("unexpected beijing mobile detail %+v", mobile)
+	}
+	unicom := links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 12, IspId: 2, IdcId: 1001}]
+	if unicom == nil || len(unicom.Sources) != 1 || !unicom.Sources[0].WeightError || unicom.Sources[0].BadWeight != "" {
+		t.Errorf("unexpected tianjin unicom detail %+v", unicom)
+	}
+	for link, weight := range map[DnsCoverLinkIdInfo]string{
+		{NationId: 156, ProvinceId: 44, IspId: 1, IdcId: 1002}: "NaN",
+		{NationId: 156, ProvinceId: 44, IspId: 4, IdcId: 1002}: "1e400",
+		{NationId: 156, ProvinceId: 12, IspId: 4, IdcId: 1001}: "-Inf",
+	} {
+		got := links[link]
+		if got == nil || got.Weight != 0 || len(got.Sources) != 1 || !got.Sources[0].WeightError || got.Sources[0].BadWeight != weight {
+			t.Errorf("link %v with weight %q got detail %+v", link, weight, got)
+		}
+	}
+}
+
+func TestGetAllLinksByCity(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	// a city of beijing, and a city given with an area which is not split
+	oss.SetFixture("res_cover_102.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"res_id": 102, "cover": [
+		{"area_id": -11, "city_id": 1101, "city_name": "haidian", "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 21, "weight": "80",
+			"idcs": [{"idc_id": 1001, "ips": []}]},
+		{"area_id": 1, "city_id": 1201, "city_name": "binhai", "isp_id": 2, "nation_id": 156, "priority": 1, "resgrp_id": 25, "weight": "10",
+			"idcs": [{"idc_id": 1001, "ips": []}]}]}]}`)
+
+	opts := testLinkOptions
+	opts.CityNationIds = map[int64]bool{156: true}
+	src := NewCgiSource("test", 2*time.Second)
+	links, _, err := GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, opts)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	city := links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, CityId: 1101, IspId: 4, IdcId: 1001}]
+	if city == nil || city.CityName != "haidian" {
+		t.Errorf("unexpected city link detail %+v", city)
+	}
+	if links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 12, IspId: 2, IdcId: 1001}] == nil {
+		t.Errorf("the link of an area cover is split by city: %v", links)
+	}
+
+	// not split for the other nations
+	opts.CityNationIds = map[int64]bool{}
+	links, _, err = GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, opts)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	if links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 4, IdcId: 1001}] == nil {
+		t.Errorf("the link is split by city: %v", links)
+	}
+}
+
+func TestGetAllLinksByArea(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+
+	src := NewCgiSource("test", 2*time.Second)
+	_, areas, err := GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, testLinkOptions)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	want := []AreaExpansion{
+		{OssIp: oss.Addr, AreaId: 1, AreaName: "north", Mode: AreaModeProvinces, ProvinceIds: []int64{11, 12}, Covers: 1},
+		{OssIp: oss.Addr, AreaId: 9, AreaName: "unknown", Mode: AreaModeUnknown, Covers: 1},
+	}
+	if !reflect.DeepEqual(areas, want) {
+		t.Errorf("got areas %+v, want %+v", areas, want)
+	}
+
+	// the areas are kept as links of their own, even those not in the geo info
+	opts := testLinkOptions
+	opts.AreaNationIds = map[int64]bool{156: true}
+	links, areas, err := GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, opts)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	for _, areaId := range []int64{1, 9} {
+		link := links[DnsCoverLinkIdInfo{NationId: 156, AreaId: areaId, IspId: 1, IdcId: 1001}]
+		if link == nil || link.AreaName == "" || link.Sources[0].AreaExpanded {
+			t.Errorf("unexpected link of area %d: %+v", areaId, link)
+		}
+	}
+	for _, provinceId := range []int64{11, 12} {
+		if links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: provinceId, IspId: 1, IdcId: 1001}] != nil {
+			t.Errorf("province %d is expanded from the area", provinceId)
+		}
+	}
+	if links[DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002}] == nil {
+		t.Errorf("the link of a province is missing: %v", links)
+	}
+	for _, area := range areas {
+		if area.Mode != AreaModeKept {
+			t.Errorf("area %+v is not kept", area)
+		}
+	}
+}
+
+func TestGetAllLinksFallbackToSlave(t *testing.T) {
+	master := osstest.NewDefaultServer()
+	defer master.Close()
+	slave := osstest.NewDefaultServer()
+	defer slave.Close()
+	master.SetFault(osstest.ResCoverCgi, osstest.Fault{Errno: 1})
+
+	src := NewCgiSource("test", 2*time.Second)
+	links, _, err := GetAllLinks(context.Background(), src, []OssDb{{Master: master.Addr, Slaver: slave.Addr}}, testLinkOptions)
+	if err != nil {
+		t.Fatalf("get all links failed: %v", err)
+	}
+	checkLinks(t, links)
+	if slave.Hits(osstest.ZoneInfoCgi) != 1 {
+		t.Errorf("slave is asked %d times, want 1", slave.Hits(osstest.ZoneInfoCgi))
+	}
+}
+
+func TestGetAllLinksFailed(t *testing.T) {
+	faults := map[string]struct {
+		cgi   string
+		fault osstest.Fault
+	}{
+		"errno":       {osstest.ZoneInfoCgi, osstest.Fault{Errno: 2}},
+		"malformed":   {osstest.ResCoverCgi, osstest.Fault{Malformed: true}},
+		"http status": {osstest.BasicInfoCgi, osstest.Fault{HttpStatus: http.StatusInternalServerError}},
+	}
+	for name, tc := range faults {
+		t.Run(name, func(t *testing.T) {
+			oss := osstest.NewDefaultServer()
+			defer oss.Close()
+			oss.SetFault(tc.cgi, tc.fault)
+
+			src := NewCgiSource("test", 2*time.Second)
+			_, _, err := GetAllLinks(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, testLinkOptions)
+			if err == nil {
+				t.Error("get all links should fail")
+			}
+		})
+	}
+}
+
+func TestGetAllLinksCancel(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	oss.SetFault(osstest.ResCoverCgi, osstest.Fault{Latency: time.Minute})
+
+	src := NewCgiSource("test", time.Minute)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := GetAllLinks(ctx, src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}, testLinkOptions)
+	if err == nil {
+		t.Fatal("get all links should fail")
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("get all links returns after %v", elapsed)
+	}
+	// the slave is skipped once the deadline passed
+	if hits := oss.Hits(osstest.ZoneInfoCgi); hits != 1 {
+		t.Errorf("zone info is asked %d times, want 1", hits)
+	}
+}
+
+func TestLoadIdcInfoMapFromCgi(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+
+	src := NewCgiSource("test", 2*time.Second)
+	idcInfo, conflicts, _, err := LoadIdcInfoMapFromCgi(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}})
+	if err != nil {
+		t.Fatalf("load idc info failed: %v", err)
+	}
+	if len(conflicts) != 0 {
+		t.Errorf("unexpected conflicts %v", conflicts)
+	}
+	if idcInfo.IdcId2Name[1001] != "bj-idc-1" || idcInfo.IdcName2Id["gz-idc-1"] != 1002 {
+		t.Errorf("unexpected idc info %v", idcInfo)
+	}
+
+	oss.SetFault(osstest.IdcQueryCgi, osstest.Fault{Malformed: true})
+	if _, _, _, err = LoadIdcInfoMapFromCgi(context.Background(), src, []OssDb{{Master: oss.Addr, Slaver: oss.Addr}}); err == nil {
+		t.Error("load idc info should fail")
+	}
+}
+
+func TestLoadGeoInfoCancel(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	oss.SetFault(osstest.BasicInfoCgi, osstest.Fault{Latency: time.Minute})
+
+	// the calls of common can not be aborted, they are left to end on the
+	// cgi timeout
+	src := NewCgiSource("test", 2*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := src.GetGeoInfo(ctx, oss.Addr); err == nil {
+		t.Error("get geo info should fail")
+	}
+	if _, err := src.GetAreaId2ProIds(ctx, oss.Addr); err == nil {
+		t.Error("get area provinces should fail")
+	}
+	// the requests are given up, not waited for until the cgi timeout
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("the requests return after %v", elapsed)
+	}
+}
+
+func TestLinksFinishWeight(t *testing.T) {
+	link := DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}
+	// added in this order, 0.1 + 0.2 + 0.3 is not 0.3 + 0.2 + 0.1
+	sum := func(weights ...float64) float64 {
+		links := make(Links)
+		for i, weight := range weights {
+			links.add(link, LinkSource{ResId: int64(i), Weight: weight}, nil)
+		}
+		links.finish()
+		return links[link].Weight
+	}
+	if a, b := sum(0.1, 0.2, 0.3), sum(0.3, 0.2, 0.1); a != b {
+		t.Errorf("the same weights in another order sum to %v and %v", a, b)
+	}
+}
@@ -1,8 +1,8 @@
 package dnslink
 
 import (
+	"context"
 	"time"
-	"common"
 )
 
 type ResInfoResponseParam struct {
@@ -43,7 +43,7 @@ type ResInfoResponse struct {
 	Errno int64                 `json:"errno"`
 	Error string                `json:"error"`
 	Seq   int64                 `json:"seq"`
-	Data  []ResInfoResponseData `json:"data, omitempty"`
+	Data  []ResInfoResponseData `json:"data,omitempty"`
 }
 
 func (res *ResInfoResponse) GetErrno() int64 {
@@ -55,9 +55,9 @@ func (res *ResInfoResponse) GetError() string {
 }
 
 // get all res_id from cgi
-func getResIds(url string, timeout time.Duration) (map[int64]bool, error) {
+func getResIds(ctx context.Context, url string, timeout time.Duration) (map[int64]bool, error) {
 	var respJson ResInfoResponse
-	err := common.GetJsonResponseFromCgi(url, timeout, &respJson)
+	err := getJsonResponseFromCgi(ctx, url, timeout, &respJson)
 	if err != nil {
 		return nil, err
 	}
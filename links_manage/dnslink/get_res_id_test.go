@@ -0,0 +1,25 @@
+package dnslink
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// the options of a json tag follow the comma without space, with the space
+// the data is still decoded but an empty one is not omitted
+func TestResInfoResponseTag(t *testing.T) {
+	var resp ResInfoResponse
+	if err := json.Unmarshal([]byte(`{"errno": 0, "data": [{"res_id": 101}]}`), &resp); err != nil {
+		t.Fatalf("decode res info failed: %v", err)
+	}
+	if len(resp.Data) != 1 || resp.Data[0].ResId != 101 {
+		t.Errorf("unexpected res info %+v", resp)
+	}
+	body, err := json.Marshal(&ResInfoResponse{})
+	if err != nil {
+		t.Fatalf("encode res info failed: %v", err)
+	}
+	if got, want := string(body), `{"errno":0,"error":"","seq":0}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
@@ -0,0 +1,206 @@
+package dnslink
+
+import (
+	. "links_manage/db_operation"
+	"sort"
+)
+
+// LinkSource is a cover entry which produces a link
+type LinkSource struct {
+	// the oss answering for the cluster
+	OssIp        string `json:"oss"`
+	ResId        int64  `json:"res_id"`
+	ResGroupId   int64  `json:"resgrp_id"`
+	ResGroupName string `json:"resgrp_name"`
+	ResGroupType int64  `json:"resgrp_type"`
+	// the area of the cover, negative for a province given directly
+	AreaId int64 `json:"area_id"`
+	// the province is one of the area, not given directly
+	AreaExpanded bool  `json:"area_expanded"`
+	Priority     int64 `json:"priority"`
+	// weight of the cover, 0 when WeightError is set
+	Weight float64 `json:"weight"`
+	// the weight of the cover is not a number, BadWeight is the string given
+	// which may be empty
+	WeightError bool   `json:"weight_error,omitempty"`
+	BadWeight   string `json:"bad_weight,omitempty"`
+}
+
+// LinkIp is an enabled ip of the idc of a link, to be probed by the detectors
+type LinkIp struct {
+	Ip  string `json:"ip"`
+	Vip string `json:"vip"`
+	// ip type of the cover cgi
+	Type int64 `json:"type"`
+	// an inner ip, not reachable from outside
+	Inner bool `json:"inner"`
+}
+
+// LinkDetail tells why a link exists and how to probe it
+type LinkDetail struct {
+	Sources []LinkSource
+	// enabled ips of the idc given by all the sources
+	Ips []LinkIp
+	// the highest, that is the smallest, priority of the sources
+	Priority int64
+	// sum of the weights of the sources
+	Weight float64
+	// name of the city given by the cover, for a link of a city
+	CityName string
+	// name of the area given by the cover, for a link of an area
+	AreaName string
+}
+
+func (detail *LinkDetail) addIp(ip LinkIp) {
+	for _, known := range detail.Ips {
+		if known == ip {
+			return
+		}
+	}
+	detail.Ips = append(detail.Ips, ip)
+}
+
+// LinkOptions selects the links and their granularity
+type LinkOptions struct {
+	ValidIspIds    map[int64]bool
+	ValidNationIds map[int64]bool
+	// nations whose links of a province are split by the city of the cover
+	CityNationIds map[int64]bool
+	// nations whose covers of an area give a link of the area instead of
+	// the links of its provinces
+	AreaNationIds map[int64]bool
+}
+
+func (opts *LinkOptions) valid(link DnsCoverLinkIdInfo) bool {
+	return opts.ValidIspIds[link.IspId] && opts.ValidNationIds[link.NationId]
+}
+
+// Links are the links found with their details
+type Links map[DnsCoverLinkIdInfo]*LinkDetail
+
+func (links Links) detail(link DnsCoverLinkIdInfo) *LinkDetail {
+	detail, ok := links[link]
+	if !ok {
+		detail = &LinkDetail{}
+		links[link] = detail
+	}
+	return detail
+}
+
+func (links Links) add(link DnsCoverLinkIdInfo, source LinkSource, ips []LinkIp) {
+	detail := links.detail(link)
+	detail.Sources = append(detail.Sources, source)
+	for _, ip := range ips {
+		detail.addIp(ip)
+	}
+}
+
+// merge the detail of another Links, other is copied so it is not shared
+func (links Links) merge(link DnsCoverLinkIdInfo, other *LinkDetail) {
+	detail := links.detail(link)
+	if detail.CityName == "" {
+		detail.CityName = other.CityName
+	}
+	if detail.AreaName == "" {
+		detail.AreaName = other.AreaName
+	}
+	detail.Sources = append(detail.Sources, other.Sources...)
+	for _, ip := range other.Ips {
+		detail.addIp(ip)
+	}
+}
+
+// sort the sources and the ips of every link, they are found in the order the
+// res and the clusters answered, and aggregate the priority and the weight.
+// The weights are added from the smallest, so the sum does not depend on the
+// order of the sources, which is the order of their osses.
+func (links Links) finish() {
+	for _, detail := range links {
+		weights := make([]float64, 0, len(detail.Sources))
+		for i, source := range detail.Sources {
+			if i == 0 || source.Priority < detail.Priority {
+				detail.Priority = source.Priority
+			}
+			weights = append(weights, source.Weight)
+		}
+		sort.Float64s(weights)
+		for _, weight := range weights {
+			detail.Weight += weight
+		}
+		ips := detail.Ips
+		sort.Slice(ips, func(i, j int) bool {
+			if ips[i].Ip != ips[j].Ip {
+				return ips[i].Ip < ips[j].Ip
+			}
+			return ips[i].Vip < ips[j].Vip
+		})
+		sources := detail.Sources
+		sort.Slice(sources, func(i, j int) bool {
+			a, b := sources[i], sources[j]
+			if a.OssIp != b.OssIp {
+				return a.OssIp < b.OssIp
+			}
+			if a.ResId != b.ResId {
+				return a.ResId < b.ResId
+			}
+			if a.ResGroupId != b.ResGroupId {
+				return a.ResGroupId < b.ResGroupId
+			}
+			return a.AreaId < b.AreaId
+		})
+	}
+}
+
+// the ways a cover of an area is turned into links
+const (
+	// a link for every province of the area
+	AreaModeProvinces = "provinces"
+	// a link of the area itself
+	AreaModeKept = "kept"
+	// no link, the area is not in the geo info of the cluster
+	AreaModeUnknown = "unknown"
+)
+
+// AreaExpansion tells how the covers of an area in a cluster are turned into
+// links
+type AreaExpansion struct {
+	OssIp    string `json:"oss"`
+	AreaId   int64  `json:"area_id"`
+	AreaName string `json:"area_name"`
+	Mode     string `json:"mode"`
+	// provinces of the area in the geo info of the cluster, sorted
+	ProvinceIds []int64 `json:"province_ids"`
+	// number of cover entries of the area
+	Covers int `json:"covers"`
+}
+
+// merge the expansions of the same area of a cluster, sorted by oss then area
+func mergeAreaExpansions(expansions []AreaExpansion) []AreaExpansion {
+	type areaKey struct {
+		ossIp  string
+		areaId int64
+	}
+	index := make(map[areaKey]int)
+	var result []AreaExpansion
+	for _, expansion := range expansions {
+		key := areaKey{expansion.OssIp, expansion.AreaId}
+		if i, ok := index[key]; ok {
+			result[i].Covers += expansion.Covers
+			if result[i].AreaName == "" {
+				result[i].AreaName = expansion.AreaName
+			}
+			continue
+		}
+		index[key] = len(result)
+		expansion.ProvinceIds = append([]int64(nil), expansion.ProvinceIds...)
+		sort.Slice(expansion.ProvinceIds, func(i, j int) bool { return expansion.ProvinceIds[i] < expansion.ProvinceIds[j] })
+		result = append(result, expansion)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].OssIp != result[j].OssIp {
+			return result[i].OssIp < result[j].OssIp
+		}
+		return result[i].AreaId < result[j].AreaId
+	})
+	return result
+}
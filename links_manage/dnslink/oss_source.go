@@ -0,0 +1,70 @@
+package dnslink
+
+import (
+	"common"
+	"context"
+	"fmt"
+	"time"
+)
+
+// OssSource provides the topology data of a cluster, the cluster is addressed
+// by one of its oss ips
+type OssSource interface {
+	// all res_id of the cluster
+	GetResIds(ctx context.Context, ossIp string) (map[int64]bool, error)
+	// cover info of one res_id
+	GetCoverInfo(ctx context.Context, ossIp string, resId int64) ([]DnsCoverInfo, error)
+	// area id to the province ids of the area
+	GetAreaId2ProIds(ctx context.Context, ossIp string) (map[int64][]int64, error)
+	// nation, area, province and isp dictionary
+	GetGeoInfo(ctx context.Context, ossIp string) (*common.GeoInfo, error)
+	// idc dictionary
+	GetIdcs(ctx context.Context, ossIp string) ([]IdcIdName, error)
+}
+
+const (
+	resUrlFormat      = "http://%s/cgi-bin/tars_oss/cgi-bin/get_zone_info_int.cgi?user=%s"
+	coverUrlFormat    = "http://%s/cgi-bin/tars_oss/cgi-bin/get_res_cover_info_int.cgi?user=%s&charip=1&res_id=%d"
+	provinceUrlFormat = "http://%s/cgi-bin/tars_oss/cgi-bin/get_cdns_basic_info_int.cgi?info_type=province&user=%s"
+	geoUrlFormat      = "http://%s/cgi-bin/tars_oss/cgi-bin/get_cdns_basic_info_int.cgi?info_type=nation,area,province,isp&user=%s"
+	idcUrlFormat      = "http://%s/cgi-bin/tars_oss/cgi-bin/idc_query_int.cgi?user=%s"
+)
+
+// CgiSource reads the topology from the tars_oss cgi
+type CgiSource struct {
+	User    string
+	Timeout time.Duration
+}
+
+func NewCgiSource(user string, timeout time.Duration) *CgiSource {
+	return &CgiSource{User: user, Timeout: timeout}
+}
+
+func (src *CgiSource) GetResIds(ctx context.Context, ossIp string) (map[int64]bool, error) {
+	return getResIds(ctx, fmt.Sprintf(resUrlFormat, ossIp, src.User), src.Timeout)
+}
+
+func (src *CgiSource) GetCoverInfo(ctx context.Context, ossIp string, resId int64) ([]DnsCoverInfo, error) {
+	var respJson DnsCoverInfoResponse
+	err := getJsonResponseFromCgi(ctx, fmt.Sprintf(coverUrlFormat, ossIp, src.User, resId), src.Timeout, &respJson)
+	if err != nil {
+		return nil, err
+	}
+	return respJson.Data, nil
+}
+
+func (src *CgiSource) GetAreaId2ProIds(ctx context.Context, ossIp string) (map[int64][]int64, error) {
+	return getAreaId2ProIds(ctx, fmt.Sprintf(provinceUrlFormat, ossIp, src.User), src.Timeout)
+}
+
+func (src *CgiSource) GetGeoInfo(ctx context.Context, ossIp string) (*common.GeoInfo, error) {
+	return LoadGeoInfoFromCgi(ctx, fmt.Sprintf(geoUrlFormat, ossIp, src.User), src.Timeout)
+}
+
+func (src *CgiSource) GetIdcs(ctx context.Context, ossIp string) ([]IdcIdName, error) {
+	idcResp, err := GetClusterIdcInfoFromCgi(ctx, fmt.Sprintf(idcUrlFormat, ossIp, src.User), src.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	return idcResp.Data, nil
+}
@@ -0,0 +1,168 @@
+// Package osstest runs a fake tars_oss cgi server from fixture files, so the
+// link extraction can be tested offline.
+//
+// The fixtures of a directory are
+//
+//	zone_info.json         get_zone_info_int.cgi
+//	basic_info.json        get_cdns_basic_info_int.cgi
+//	idc_query.json         idc_query_int.cgi
+//	res_cover_<res_id>.json get_res_cover_info_int.cgi
+package osstest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ZoneInfoCgi  = "get_zone_info_int.cgi"
+	ResCoverCgi  = "get_res_cover_info_int.cgi"
+	BasicInfoCgi = "get_cdns_basic_info_int.cgi"
+	IdcQueryCgi  = "idc_query_int.cgi"
+)
+
+const cgiPathPrefix = "/cgi-bin/tars_oss/cgi-bin/"
+
+// Fault is injected into every response of a cgi
+type Fault struct {
+	// answer after the latency, or when the client gives up
+	Latency time.Duration
+	// answer with the http status instead of the fixture
+	HttpStatus int
+	// answer with the errno in a valid cgi response
+	Errno int64
+	// answer with a broken json
+	Malformed bool
+}
+
+type Server struct {
+	// host:port of the server, to be used as an oss ip
+	Addr string
+
+	dir    string
+	server *httptest.Server
+
+	mu       sync.Mutex
+	faults   map[string]Fault
+	hits     map[string]int
+	fixtures map[string][]byte
+}
+
+// NewServer starts a server which serves the fixtures in dir
+func NewServer(dir string) *Server {
+	s := &Server{dir: dir, faults: make(map[string]Fault), hits: make(map[string]int), fixtures: make(map[string][]byte)}
+	s.server = httptest.NewServer(http.HandlerFunc(s.serveCgi))
+	s.Addr = strings.TrimPrefix(s.server.URL, "http://")
+	return s
+}
+
+// NewDefaultServer starts a server which serves the fixtures of this package
+func NewDefaultServer() *Server {
+	_, file, _, _ := runtime.Caller(0)
+	return NewServer(filepath.Join(filepath.Dir(file), "testdata"))
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+func (s *Server) SetFault(cgi string, fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults[cgi] = fault
+}
+
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = make(map[string]Fault)
+}
+
+// SetFixture serves content instead of the fixture file name of the dir, so a
+// cluster differing from the default one is set up without another dir
+func (s *Server) SetFixture(name, content string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.fixtures[name] = []byte(content)
+}
+
+// Hits returns how many requests the cgi has received
+func (s *Server) Hits(cgi string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hits[cgi]
+}
+
+func (s *Server) fixtureFile(cgi string, r *http.Request) (string, error) {
+	switch cgi {
+	case ZoneInfoCgi:
+		return "zone_info.json", nil
+	case BasicInfoCgi:
+		return "basic_info.json", nil
+	case IdcQueryCgi:
+		return "idc_query.json", nil
+	case ResCoverCgi:
+		resId := r.URL.Query().Get("res_id")
+		if resId == "" {
+			return "", fmt.Errorf("no res_id")
+		}
+		return fmt.Sprintf("res_cover_%s.json", resId), nil
+	}
+	return "", fmt.Errorf("unknown cgi %s", cgi)
+}
+
+func (s *Server) serveCgi(w http.ResponseWriter, r *http.Request) {
+	if !strings.HasPrefix(r.URL.Path, cgiPathPrefix) {
+		http.NotFound(w, r)
+		return
+	}
+	cgi := strings.TrimPrefix(r.URL.Path, cgiPathPrefix)
+	s.mu.Lock()
+	s.hits[cgi]++
+	fault := s.faults[cgi]
+	s.mu.Unlock()
+
+	if fault.Latency > 0 {
+		select {
+		case <-time.After(fault.Latency):
+		case <-r.Context().Done():
+			return
+		}
+	}
+	if fault.HttpStatus != 0 {
+		w.WriteHeader(fault.HttpStatus)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if fault.Errno != 0 {
+		fmt.Fprintf(w, `{"errno": %d, "error": "injected error", "seq": 0, "data": []}`, fault.Errno)
+		return
+	}
+	if fault.Malformed {
+		fmt.Fprint(w, `{"errno": 0, "error": "", "data": [{"res_id": `)
+		return
+	}
+	name, err := s.fixtureFile(cgi, r)
+	if err != nil {
+		fmt.Fprintf(w, `{"errno": 1, "error": %q, "seq": 0, "data": []}`, err.Error())
+		return
+	}
+	s.mu.Lock()
+	content, ok := s.fixtures[name]
+	s.mu.Unlock()
+	if !ok {
+		content, err = ioutil.ReadFile(filepath.Join(s.dir, name))
+	}
+	if err != nil {
+		fmt.Fprintf(w, `{"errno": 1, "error": "no fixture %s", "seq": 0, "data": []}`, name)
+		return
+	}
+	w.Write(content)
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"encoding/csv"
+	"expvar"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"links_manage/db_operation"
+	"links_manage/dnslink"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Router returns the handler of the server api, middleware is used before all
+func (s *Server) Router(middleware ...gin.HandlerFunc) *gin.Engine {
+	router := gin.New()
+	router.Use(middleware...)
+	router.Use(gin.Recovery())
+	router.Use(clientIdentityMiddleware)
+	router.GET("/is_detect_link_changed", s.isDetectLinksChangedHandler)
+	router.GET("/query_detect_links", s.queryDetectLinksHandler)
+	router.POST("/post_detect_links_change", s.postLinkDataHandler)
+	router.GET("/query_link_masks", s.queryLinkMasksHandler)
+	router.GET("/leader_status", s.leaderStatusHandler)
+	router.GET("/debug/vars", gin.WrapH(expvar.Handler()))
+	router.GET("/debug/dict_conflicts", s.dictConflictsHandler)
+	router.GET("/debug/untranslated_links", s.untranslatedLinksHandler)
+	router.GET("/debug/bad_weights", s.badWeightsHandler)
+	router.GET("/debug/area_expansions", s.areaExpansionsHandler)
+	router.GET("/coverage_redundancy", s.coverageRedundancyHandler)
+	router.GET("/coverage_health", s.coverageHealthHandler)
+	router.GET("/alerts", s.alertsHandler)
+	router.GET("/debug/webhook_deliveries", s.webhookDeliveriesHandler)
+	return router
+}
+
+func (s *Server) isDetectLinksChangedHandler(c *gin.Context) {
+	rVersionId, err := strconv.ParseInt(c.Query("version_id"), 10, 64)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"errno": 1, "error": "no valid version id"})
+	} else {
+		changeFlag := false
+		if versionId := s.snapshot().versionId; rVersionId != versionId {
+			changeFlag = true
+			rVersionId = versionId
+		}
+		c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "is_changed": changeFlag, "version_id": rVersionId})
+	}
+}
+
+// linkView is a link with its scheduling attributes and the details asked by
+// the query
+type linkView struct {
+	linkdb.DnsCoverLinkNameInfo
+	Priority int64                `json:"priority"`
+	Weight   float64              `json:"weight"`
+	Sources  []dnslink.LinkSource `json:"sources,omitempty"`
+	Ips      []dnslink.LinkIp     `json:"ips,omitempty"`
+}
+
+// a flag is set by ?name or ?name=1, but not by ?name=0 or ?name=false
+func queryFlag(c *gin.Context, name string) bool {
+	value, ok := c.GetQuery(name)
+	return ok && value != "0" && value != "false"
+}
+
+// filter of the ips, by ?ip_type=<type> and ?ip_scope=inner|outer
+type ipFilter struct {
+	ipType  int64
+	anyType bool
+	scope   string
+}
+
+func parseIpFilter(c *gin.Context) (ipFilter, error) {
+	filter := ipFilter{anyType: true, scope: c.Query("ip_scope")}
+	if ipType := c.Query("ip_type"); ipType != "" {
+		var err error
+		if filter.ipType, err = strconv.ParseInt(ipType, 10, 64); err != nil {
+			return filter, fmt.Errorf("invalid ip_type %s", ipType)
+		}
+		filter.anyType = false
+	}
+	if filter.scope != "" && filter.scope != "inner" && filter.scope != "outer" {
+		return filter, fmt.Errorf("invalid ip_scope %s", filter.scope)
+	}
+	return filter, nil
+}
+
+func (filter ipFilter) apply(ips []dnslink.LinkIp) []dnslink.LinkIp {
+	var result []dnslink.LinkIp
+	for _, ip := range ips {
+		if !filter.anyType && ip.Type != filter.ipType {
+			continue
+		}
+		if (filter.scope == "inner" && !ip.Inner) || (filter.scope == "outer" && ip.Inner) {
+			continue
+		}
+		result = append(result, ip)
+	}
+	return result
+}
+
+// merge the links of the cities into the links of their provinces
+func collapseToProvince(links []linkView) []linkView {
+	index := make(map[linkdb.DnsCoverLinkNameInfo]int)
+	var result []linkView
+	for _, link := range links {
+		link.CityName = ""
+		i, ok := index[link.DnsCoverLinkNameInfo]
+		if !ok {
+			index[link.DnsCoverLinkNameInfo] = len(result)
+			result = append(result, link)
+			continue
+		}
+		merged := &result[i]
+		if link.Priority < merged.Priority {
+			merged.Priority = link.Priority
+		}
+		merged.Weight += link.Weight
+		// the sources of the snapshot are not appended in place
+		merged.Sources = append(append([]dnslink.LinkSource(nil), merged.Sources...), link.Sources...)
+		for _, ip := range link.Ips {
+			known := false
+			for _, mergedIp := range merged.Ips {
+				known = known || mergedIp == ip
+			}
+			if !known {
+				merged.Ips = append(merged.Ips, ip)
+			}
+		}
+	}
+	return result
+}
+
+// the names of the links, with their priority and weight with ?weights, their
+// sources with ?verbose and the ips to probe with ?ips. The links are split by
+// city for the nations configured, ?granularity=province merges them into
+// the links of their provinces.
+func (s *Server) queryDetectLinksHandler(c *gin.Context) {
+	snap := s.snapshot()
+	verbose, withIps := queryFlag(c, "verbose"), queryFlag(c, "ips")
+	namesOnly := !verbose && !withIps && !queryFlag(c, "weights")
+	granularity := c.Query("granularity")
+	if granularity != "" && granularity != "city" && granularity != "province" {
+		c.JSON(http.StatusOK, gin.H{"errno": 1, "error": "invalid granularity " + granularity})
+		return
+	}
+	if namesOnly && granularity != "province" {
+		c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "version_id": snap.versionId, "links": snap.linkNameData})
+		return
+	}
+	filter, err := parseIpFilter(c)
+	if err != nil {
+		c.JSON(http.StatusOK, gin.H{"errno": 1, "error": err.Error()})
+		return
+	}
+	links := make([]linkView, len(snap.linkNameData))
+	for i, linkName := range snap.linkNameData {
+		detail := snap.linkIdData[snap.linkNameIds[i]]
+		links[i].DnsCoverLinkNameInfo = linkName
+		links[i].Priority = detail.Priority
+		links[i].Weight = detail.Weight
+		if verbose {
+			links[i].Sources = detail.Sources
+		}
+		if withIps {
+			links[i].Ips = filter.apply(detail.Ips)
+		}
+	}
+	if granularity == "province" {
+		links = collapseToProvince(links)
+	}
+	if namesOnly {
+		names := make([]linkdb.DnsCoverLinkNameInfo, len(links))
+		for i := range links {
+			names[i] = links[i].DnsCoverLinkNameInfo
+		}
+		c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "version_id": snap.versionId, "links": names})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "version_id": snap.versionId, "links": links})
+}
+
+func (s *Server) postLinkDataHandler(c *gin.Context) {
+	var postLinks []linkdb.PostLink
+	if err := c.ShouldBindJSON(&postLinks); err != nil {
+		glog.Warningf("decode json failed for %s", err.Error())
+		c.JSON(http.StatusOK, gin.H{"errno": 1, "error": "decode post json failed"})
+	} else {
+		var postLinkIds []linkdb.PostLinkId
+		var validLinks []linkdb.PostLink
+		// the links without ids in the dictionaries, told back to the client
+		rejectedLinks := []linkdb.PostLink{}
+		operator := clientIdentity(c)
+		snap := s.snapshot()
+		for _, plink := range postLinks {
+			linkId, err := plink.TransformToIdInfo(snap.geoInfo, snap.idcInfo.IdcName2Id)
+			if err == nil {
+				var postLinkId linkdb.PostLinkId
+				postLinkId.ExceptionMask = plink.ExceptionMask
+				postLinkId.DnsCoverLinkIdInfo = linkId
+				postLinkIds = append(postLinkIds, postLinkId)
+				validLinks = append(validLinks, plink)
+				glog.Infof("post link:  nation:%s, province: %s, isp:%s, idc:%s, mask:%d, operator:%s", plink.NationName, plink.ProvinceName, plink.IspName, plink.IdcName, plink.ExceptionMask, operator)
+			} else {
+				glog.Warningf("invalid links change info %v", plink)
+				rejectedLinks = append(rejectedLinks, plink)
+			}
+		}
+		if len(postLinkIds) == 0 {
+			glog.Warning("has no valid links change")
+			c.JSON(http.StatusOK, gin.H{"errno": 2, "error": "no valid links", "accepted": 0, "rejected": rejectedLinks})
+			return
+		}
+		// the ip stands for the operator without mtls
+		updatedBy := operator
+		if updatedBy == "" {
+			updatedBy = c.ClientIP()
+		}
+		rowCount, err := linkdb.UpdateLinkMask(s.db, postLinkIds, updatedBy)
+		if err != nil {
+			glog.Errorf("update link mask failed for %s", err.Error())
+			c.JSON(http.StatusOK, gin.H{"errno": 3, "error": "internal error"})
+		} else {
+			glog.Infof("update %d link mask success, operator:%s", rowCount, operator)
+			if s.webhooks != nil {
+				s.webhooks.emit(eventMasksUpdated, &masksUpdatedData{Operator: operator, RowCount: rowCount, Links: validLinks})
+			}
+			c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "accepted": len(validLinks), "rejected": rejectedLinks})
+		}
+	}
+}
+
+// maskView is a mask with who set it and when
+type maskView struct {
+	linkdb.PostLink
+	UpdatedBy  string    `json:"updated_by"`
+	UpdateTime time.Time `json:"update_time"`
+}
+
+// the links with a non zero exception mask, those without names in the
+// current dictionaries are only counted
+func (s *Server) queryLinkMasksHandler(c *gin.Context) {
+	records, err := linkdb.GetLinkMaskRecords(s.db)
+	if err != nil {
+		glog.Errorf("get link masks failed for %s", err.Error())
+		c.JSON(http.StatusOK, gin.H{"errno": 3, "error": "internal error"})
+		return
+	}
+	snap := s.snapshot()
+	result := make([]maskView, 0, len(records))
+	untranslated := 0
+	for _, record := range records {
+		name, err := record.TransformToNameInfo(snap.geoInfo, snap.idcInfo.IdcId2Name)
+		if err != nil {
+			untranslated++
+			continue
+		}
+		result = append(result, maskView{
+			PostLink:   linkdb.PostLink{DnsCoverLinkNameInfo: name, ExceptionMask: record.ExceptionMask},
+			UpdatedBy:  record.UpdatedBy,
+			UpdateTime: record.UpdateTime,
+		})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.NationName != b.NationName {
+			return a.NationName < b.NationName
+		}
+		if a.ProvinceName != b.ProvinceName {
+			return a.ProvinceName < b.ProvinceName
+		}
+		if a.IspName != b.IspName {
+			return a.IspName < b.IspName
+		}
+		return a.IdcName < b.IdcName
+	})
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "count": len(result), "untranslated": untranslated, "masks": result})
+}
+
+func (s *Server) dictConflictsHandler(c *gin.Context) {
+	snap := s.snapshot()
+	conflicts := append(append([]dnslink.DictConflict{}, snap.geoConflicts...), snap.idcConflicts...)
+	missing := gin.H{"geo": snap.geoMissing, "idc": snap.idcMissing}
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "conflicts": conflicts, "missing_clusters": missing})
+}
+
+func (s *Server) untranslatedLinksHandler(c *gin.Context) {
+	links := s.snapshot().untranslatedLinks
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "count": len(links), "links": links})
+}
+
+func (s *Server) badWeightsHandler(c *gin.Context) {
+	badWeights := s.snapshot().badWeights
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "count": len(badWeights), "bad_weights": badWeights})
+}
+
+func (s *Server) areaExpansionsHandler(c *gin.Context) {
+	areas := s.snapshot().areaExpansions
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "count": len(areas), "areas": areas})
+}
+
+// the idcs covering each province and isp, ?format=csv exports them as csv
+// and ?single_point lists only those covered by a single idc
+func (s *Server) coverageRedundancyHandler(c *gin.Context) {
+	snap := s.snapshot()
+	coverages := snap.redundancy
+	if queryFlag(c, "single_point") {
+		coverages = nil
+		for _, coverage := range snap.redundancy {
+			if coverage.SinglePoint {
+				coverages = append(coverages, coverage)
+			}
+		}
+	}
+	switch format := c.Query("format"); format {
+	case "", "json":
+		c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "version_id": snap.versionId, "count": len(coverages), "coverages": coverages})
+	case "csv":
+		c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=coverage_redundancy_%d.csv", snap.versionId))
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+		c.Status(http.StatusOK)
+		w := csv.NewWriter(c.Writer)
+		if err := w.WriteAll(redundancyRecords(coverages)); err != nil {
+			glog.Warningf("write coverage redundancy csv failed: %s", err.Error())
+		}
+	default:
+		c.JSON(http.StatusOK, gin.H{"errno": 1, "error": "invalid format " + format})
+	}
+}
+
+// the covering idcs of each province and isp left by the exception masks,
+// ?impaired lists only those with a masked idc
+func (s *Server) coverageHealthHandler(c *gin.Context) {
+	report, err := s.coverageHealth()
+	if err != nil {
+		glog.Errorf("check coverage health failed for %s", err.Error())
+		c.JSON(http.StatusOK, gin.H{"errno": 3, "error": "internal error"})
+		return
+	}
+	if queryFlag(c, "impaired") {
+		var impaired []coverageHealth
+		for _, coverage := range report.Coverages {
+			if len(coverage.MaskedIdcs) > 0 {
+				impaired = append(impaired, coverage)
+			}
+		}
+		report.Coverages = impaired
+	}
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "health": report})
+}
+
+// the alerts firing on this replica, and the last deliveries of the alerts
+func (s *Server) alertsHandler(c *gin.Context) {
+	var alerts []alert
+	var deliveries []webhookDelivery
+	if s.alerter != nil {
+		alerts = s.alerter.firingAlerts()
+		deliveries = s.alerter.webhooks.deliveryLog()
+	}
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "count": len(alerts), "alerts": alerts, "deliveries": deliveries})
+}
+
+func (s *Server) webhookDeliveriesHandler(c *gin.Context) {
+	var deliveries []webhookDelivery
+	if s.webhooks != nil {
+		deliveries = s.webhooks.deliveryLog()
+	}
+	c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "count": len(deliveries), "deliveries": deliveries})
+}
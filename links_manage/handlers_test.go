@@ -0,0 +1,473 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"links_manage/db_operation"
+	"links_manage/dnslink"
+	"links_manage/dnslink/osstest"
+)
+
+type testResponse struct {
+	Errno     int64                         `json:"errno"`
+	Error     string                        `json:"error"`
+	IsChanged bool                          `json:"is_changed"`
+	VersionId int64                         `json:"version_id"`
+	Links     []linkdb.DnsCoverLinkNameInfo `json:"links"`
+	Accepted  int                           `json:"accepted"`
+	Rejected  []linkdb.PostLink             `json:"rejected"`
+}
+
+func doRequest(t *testing.T, router *gin.Engine, req *http.Request) testResponse {
+	t.Helper()
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("%s %s return http status %d", req.Method, req.URL, w.Code)
+	}
+	var resp testResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	return resp
+}
+
+func TestIsDetectLinksChangedHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, _ := startTestServer(t, testConfig())
+	router := s.Router()
+
+	resp := doRequest(t, router, httptest.NewRequest(http.MethodGet, "/is_detect_link_changed?version_id=0", nil))
+	if resp.Errno != 0 || !resp.IsChanged {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	resp = doRequest(t, router, httptest.NewRequest(http.MethodGet, "/is_detect_link_changed?version_id="+strconv.FormatInt(resp.VersionId, 10), nil))
+	if resp.Errno != 0 || resp.IsChanged {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	resp = doRequest(t, router, httptest.NewRequest(http.MethodGet, "/is_detect_link_changed", nil))
+	if resp.Errno != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestQueryDetectLinksHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, _ := startTestServer(t, testConfig())
+
+	resp := doRequest(t, s.Router(), httptest.NewRequest(http.MethodGet, "/query_detect_links", nil))
+	if resp.Errno != 0 || resp.VersionId != s.versionId() {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	want := map[linkdb.DnsCoverLinkNameInfo]bool{
+		{NationName: "china", ProvinceName: "beijing", IspName: "telecom", IdcName: "bj-idc-1"}:  true,
+		{NationName: "china", ProvinceName: "tianjin", IspName: "telecom", IdcName: "bj-idc-1"}:  true,
+		{NationName: "china", ProvinceName: "guangdong", IspName: "unicom", IdcName: "gz-idc-1"}: true,
+		{NationName: "china", ProvinceName: "beijing", IspName: "mobile", IdcName: "bj-idc-1"}:   true,
+		{NationName: "china", ProvinceName: "beijing", IspName: "mobile", IdcName: "gz-idc-1"}:   true,
+	}
+	if len(resp.Links) != len(want) {
+		t.Errorf("got %d links, want %d", len(resp.Links), len(want))
+	}
+	for _, link := range resp.Links {
+		if !want[link] {
+			t.Errorf("unexpected link %+v", link)
+		}
+	}
+}
+
+func TestQueryDetectLinksVerbose(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, oss, _ := startTestServer(t, testConfig())
+
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/query_detect_links?verbose", nil))
+	var resp struct {
+		Links []linkView `json:"links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	if len(resp.Links) != 5 {
+		t.Fatalf("got %d links, want 5", len(resp.Links))
+	}
+	gzLink := linkdb.DnsCoverLinkNameInfo{NationName: "china", ProvinceName: "guangdong", IspName: "unicom", IdcName: "gz-idc-1"}
+	wantSources := []dnslink.LinkSource{
+		{OssIp: oss.Addr, ResId: 101, ResGroupId: 12, ResGroupName: "gd-unicom", ResGroupType: 2, AreaId: -44, Priority: 2, Weight: 50},
+	}
+	for _, link := range resp.Links {
+		if link.DnsCoverLinkNameInfo == gzLink && (!reflect.DeepEqual(link.Sources, wantSources) || link.Priority != 2 || link.Weight != 50) {
+			t.Errorf("link %+v got %+v, want sources %+v", gzLink, link, wantSources)
+		}
+		if len(link.Sources) == 0 {
+			t.Errorf("link %+v has no source", link.DnsCoverLinkNameInfo)
+		}
+	}
+}
+
+func TestQueryDetectLinksIps(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, _ := startTestServer(t, testConfig())
+	router := s.Router()
+	bjLink := linkdb.DnsCoverLinkNameInfo{NationName: "china", ProvinceName: "beijing", IspName: "telecom", IdcName: "bj-idc-1"}
+
+	queries := map[string][]dnslink.LinkIp{
+		"ips": {
+			{Ip: "10.0.0.1", Vip: "1.1.1.1", Type: 1},
+			{Ip: "192.168.0.1", Type: 2, Inner: true},
+		},
+		"ips&ip_type=1":                {{Ip: "10.0.0.1", Vip: "1.1.1.1", Type: 1}},
+		"ips&ip_scope=inner":           {{Ip: "192.168.0.1", Type: 2, Inner: true}},
+		"ips&ip_scope=outer&ip_type=2": nil,
+	}
+	for query, want := range queries {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/query_detect_links?"+query, nil))
+		var resp struct {
+			Links []linkView `json:"links"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+		}
+		found := false
+		for _, link := range resp.Links {
+			if link.DnsCoverLinkNameInfo == bjLink {
+				found = true
+				if !reflect.DeepEqual(link.Ips, want) {
+					t.Errorf("query %s got ips %+v, want %+v", query, link.Ips, want)
+				}
+			}
+			if link.Sources != nil {
+				t.Errorf("query %s got sources without verbose", query)
+			}
+		}
+		if !found {
+			t.Errorf("query %s has no link %+v", query, bjLink)
+		}
+	}
+
+	resp := doRequest(t, router, httptest.NewRequest(http.MethodGet, "/query_detect_links?ips&ip_scope=public", nil))
+	if resp.Errno != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestQueryDetectLinksGranularity(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	// two cities of beijing on the same idc
+	oss.SetFixture("res_cover_102.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"res_id": 102, "cover": [
+		{"area_id": -11, "city_id": 1101, "city_name": "haidian", "isp_id": 4, "nation_id": 156, "priority": 2, "resgrp_id": 21, "weight": "80",
+			"idcs": [{"idc_id": 1001, "ips": []}]},
+		{"area_id": -11, "city_id": 1102, "city_name": "chaoyang", "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 26, "weight": "20",
+			"idcs": [{"idc_id": 1001, "ips": []}]}]}]}`)
+	conf := testConfig()
+	conf.CityNationIds = map[int64]bool{156: true}
+	s, _ := startTestServerOn(t, conf, oss)
+	router := s.Router()
+
+	cityLinks := 0
+	for _, link := range doRequest(t, router, httptest.NewRequest(http.MethodGet, "/query_detect_links", nil)).Links {
+		if link.IspName == "mobile" && (link.CityName == "haidian" || link.CityName == "chaoyang") {
+			cityLinks++
+		}
+	}
+	if cityLinks != 2 {
+		t.Errorf("got %d links of cities, want 2", cityLinks)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/query_detect_links?granularity=province&verbose", nil))
+	var resp struct {
+		Links []linkView `json:"links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	bjMobile := linkdb.DnsCoverLinkNameInfo{NationName: "china", ProvinceName: "beijing", IspName: "mobile", IdcName: "bj-idc-1"}
+	found := 0
+	for _, link := range resp.Links {
+		if link.CityName != "" {
+			t.Errorf("link %+v has a city with granularity province", link.DnsCoverLinkNameInfo)
+		}
+		if link.DnsCoverLinkNameInfo == bjMobile {
+			found++
+			if link.Priority != 1 || link.Weight != 100 || len(link.Sources) != 2 {
+				t.Errorf("unexpected merged link %+v", link)
+			}
+		}
+	}
+	if found != 1 {
+		t.Errorf("got %d links %+v, want 1", found, bjMobile)
+	}
+	// the snapshot is not modified by the merge
+	for _, detail := range s.snapshot().linkIdData {
+		if len(detail.Sources) != 1 {
+			t.Errorf("snapshot link has %d sources after the query", len(detail.Sources))
+		}
+	}
+
+	resp2 := doRequest(t, router, httptest.NewRequest(http.MethodGet, "/query_detect_links?granularity=idc", nil))
+	if resp2.Errno != 1 {
+		t.Errorf("unexpected response %+v", resp2)
+	}
+}
+
+func TestBadWeightsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	oss.SetFixture("res_cover_102.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"res_id": 102, "cover": [
+		{"area_id": -11, "isp_id": 4, "nation_id": 156, "priority": 1, "resgrp_id": 21, "weight": "heavy",
+			"idcs": [{"idc_id": 1001, "ips": []}, {"idc_id": 1002, "ips": []}]},
+		{"area_id": -44, "isp_id": 2, "nation_id": 156, "priority": 1, "resgrp_id": 22, "weight": "",
+			"idcs": [{"idc_id": 1002, "ips": []}]}]}]}`)
+	s, _ := startTestServerOn(t, testConfig(), oss)
+
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/bad_weights", nil))
+	var resp struct {
+		BadWeights []badWeight `json:"bad_weights"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	// reported once for the two links of the cover, an empty weight is bad too
+	want := []badWeight{
+		{OssIp: oss.Addr, ResId: 102, ResGroupId: 21, Weight: "heavy"},
+		{OssIp: oss.Addr, ResId: 102, ResGroupId: 22, Weight: ""},
+	}
+	if !reflect.DeepEqual(resp.BadWeights, want) {
+		t.Errorf("got bad weights %+v, want %+v", resp.BadWeights, want)
+	}
+}
+
+func TestAreaExpansionsHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	conf := testConfig()
+	conf.AreaNationIds = map[int64]bool{156: true}
+	s, oss, _ := startTestServer(t, conf)
+	router := s.Router()
+
+	northLink := linkdb.DnsCoverLinkNameInfo{NationName: "china", AreaName: "north", IspName: "telecom", IdcName: "bj-idc-1"}
+	found := false
+	for _, link := range doRequest(t, router, httptest.NewRequest(http.MethodGet, "/query_detect_links", nil)).Links {
+		found = found || link == northLink
+	}
+	if !found {
+		t.Errorf("link %+v of the area is missing", northLink)
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/area_expansions", nil))
+	var resp struct {
+		Areas []dnslink.AreaExpansion `json:"areas"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	want := []dnslink.AreaExpansion{
+		{OssIp: oss.Addr, AreaId: 1, AreaName: "north", Mode: dnslink.AreaModeKept, ProvinceIds: []int64{11, 12}, Covers: 1},
+		{OssIp: oss.Addr, AreaId: 9, AreaName: "unknown", Mode: dnslink.AreaModeKept, Covers: 1},
+	}
+	if !reflect.DeepEqual(resp.Areas, want) {
+		t.Errorf("got areas %+v, want %+v", resp.Areas, want)
+	}
+}
+
+func TestCoverageRedundancyHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, _ := startTestServer(t, testConfig())
+	router := s.Router()
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/coverage_redundancy", nil))
+	var resp struct {
+		Coverages []coverageRedundancy `json:"coverages"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	want := []coverageRedundancy{
+		{Nation: "china", Province: "beijing", Isp: "mobile", Idcs: []string{"bj-idc-1", "gz-idc-1"}, IdcCount: 2},
+		{Nation: "china", Province: "beijing", Isp: "telecom", Idcs: []string{"bj-idc-1"}, IdcCount: 1, SinglePoint: true},
+		{Nation: "china", Province: "guangdong", Isp: "unicom", Idcs: []string{"gz-idc-1"}, IdcCount: 1, SinglePoint: true},
+		{Nation: "china", Province: "tianjin", Isp: "telecom", Idcs: []string{"bj-idc-1"}, IdcCount: 1, SinglePoint: true},
+	}
+	if !reflect.DeepEqual(resp.Coverages, want) {
+		t.Errorf("got coverages %+v, want %+v", resp.Coverages, want)
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/coverage_redundancy?format=csv&single_point", nil))
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("read csv failed: %v", err)
+	}
+	if len(records) != 4 || records[0][0] != "nation" {
+		t.Errorf("unexpected csv records %v", records)
+	}
+	if got := strings.Join(records[1], ","); got != "china,beijing,,telecom,1,1,bj-idc-1" {
+		t.Errorf("unexpected csv record %s", got)
+	}
+
+	if resp := doRequest(t, router, httptest.NewRequest(http.MethodGet, "/coverage_redundancy?format=xml", nil)); resp.Errno != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+const getLinkMasksSql = "SELECT nation_id, province_id, isp_id, idc_id, exception_mask FROM link_detect_info WHERE exception_mask<>0"
+
+const getLinkMaskRecordsSql = "SELECT nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, UNIX_TIMESTAMP(ctime) FROM link_detect_info WHERE exception_mask<>0"
+
+// the upsert of one mask
+const updateLinkMaskSql = "INSERT INTO link_detect_info(nation_id, province_id, isp_id, idc_id, exception_mask, updated_by, ctime) VALUES" +
+	"(?, ?, ?, ?, ?, ?, NOW()) ON DUPLICATE KEY UPDATE exception_mask=VALUES(exception_mask), updated_by=VALUES(updated_by), ctime=NOW()"
+
+func TestCoverageHealthHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, mock := startTestServer(t, testConfig())
+	router := s.Router()
+
+	// beijing telecom is down, and one of the two idcs of beijing mobile
+	mock.ExpectQuery(getLinkMasksSql).
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask"}).
+			AddRow(156, 11, 1, 1001, 1).
+			AddRow(156, 11, 4, 1001, 2))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/coverage_health?impaired", nil))
+	var resp struct {
+		Errno  int64         `json:"errno"`
+		Health *healthReport `json:"health"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	if resp.Errno != 0 || resp.Health == nil {
+		t.Fatalf("unexpected response %s", w.Body.String())
+	}
+	report := resp.Health
+	if report.Idcs != 5 || report.MaskedIdcs != 2 || report.Impaired != 0.4 || report.ImpairedCoverages != 2 || report.DownCoverages != 1 {
+		t.Errorf("unexpected report %+v", report)
+	}
+	want := []coverageHealth{
+		{Nation: "china", Province: "beijing", Isp: "mobile", Idcs: 2, MaskedIdcs: []string{"bj-idc-1"}, HealthyIdcs: 1, Impaired: 0.5},
+		{Nation: "china", Province: "beijing", Isp: "telecom", Idcs: 1, MaskedIdcs: []string{"bj-idc-1"}, Impaired: 1},
+	}
+	if !reflect.DeepEqual(report.Coverages, want) {
+		t.Errorf("got coverages %+v, want %+v", report.Coverages, want)
+	}
+	if value := coverageHealthMetric.Get("down_coverages").String(); value != "1" {
+		t.Errorf("down coverages metric is %s, want 1", value)
+	}
+
+	mock.ExpectQuery(getLinkMasksSql).
+		WillReturnError(errors.New("connection reset"))
+	if resp := doRequest(t, router, httptest.NewRequest(http.MethodGet, "/coverage_health", nil)); resp.Errno != 3 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+}
+
+func TestQueryLinkMasksHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, mock := startTestServer(t, testConfig())
+
+	// the second link has no idc name
+	mock.ExpectQuery(getLinkMaskRecordsSql).
+		WillReturnRows(sqlmock.NewRows([]string{"nation_id", "province_id", "isp_id", "idc_id", "exception_mask", "updated_by", "ctime"}).
+			AddRow(156, 11, 1, 1001, 1, "prober-1", 1700000000).
+			AddRow(156, 11, 1, 1999, 2, "prober-1", 1700000000))
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/query_link_masks", nil))
+	var resp struct {
+		Errno        int64      `json:"errno"`
+		Untranslated int        `json:"untranslated"`
+		Masks        []maskView `json:"masks"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	want := []maskView{{
+		PostLink: linkdb.PostLink{
+			DnsCoverLinkNameInfo: linkdb.DnsCoverLinkNameInfo{NationName: "china", ProvinceName: "beijing", IspName: "telecom", IdcName: "bj-idc-1"},
+			ExceptionMask:        1,
+		},
+		UpdatedBy:  "prober-1",
+		UpdateTime: time.Unix(1700000000, 0),
+	}}
+	if resp.Errno != 0 || resp.Untranslated != 1 || len(resp.Masks) != 1 || !resp.Masks[0].UpdateTime.Equal(want[0].UpdateTime) {
+		t.Errorf("unexpected response %s", w.Body.String())
+	}
+	resp.Masks[0].UpdateTime = want[0].UpdateTime
+	if !reflect.DeepEqual(resp.Masks, want) {
+		t.Errorf("unexpected response %s", w.Body.String())
+	}
+}
+
+func TestPostLinkDataHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s, _, mock := startTestServer(t, testConfig())
+	router := s.Router()
+
+	resp := doRequest(t, router, httptest.NewRequest(http.MethodPost, "/post_detect_links_change", bytes.NewBufferString("[{")))
+	if resp.Errno != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	body := `[{"nation": "china", "province": "nowhere", "isp": "telecom", "idc_name": "bj-idc-1", "exception_mask": 1}]`
+	resp = doRequest(t, router, httptest.NewRequest(http.MethodPost, "/post_detect_links_change", bytes.NewBufferString(body)))
+	if resp.Errno != 2 || resp.Accepted != 0 || len(resp.Rejected) != 1 {
+		t.Errorf("unexpected response %+v", resp)
+	}
+
+	mock.ExpectExec(updateLinkMaskSql).
+		WithArgs(156, 11, 1, 1001, 1, "192.0.2.1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// the links without ids are told back, the others are written
+	body = `[{"nation": "china", "province": "beijing", "isp": "telecom", "idc_name": "bj-idc-1", "exception_mask": 1},
+		{"nation": "china", "province": "beijing", "isp": "telecom", "idc_name": "nowhere-idc", "exception_mask": 1}]`
+	resp = doRequest(t, router, httptest.NewRequest(http.MethodPost, "/post_detect_links_change", bytes.NewBufferString(body)))
+	if resp.Errno != 0 || resp.Accepted != 1 || len(resp.Rejected) != 1 || resp.Rejected[0].IdcName != "nowhere-idc" {
+		t.Errorf("unexpected response %+v", resp)
+	}
+	if err := mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUntranslatedLinksHandler(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	oss.SetFixture("idc_query.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"id": 1001, "idcName": "bj-idc-1"}]}`)
+	s, _ := startTestServerOn(t, testConfig(), oss)
+
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/debug/untranslated_links", nil))
+	var resp struct {
+		Count int                `json:"count"`
+		Links []untranslatedLink `json:"links"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	want := []untranslatedLink{
+		{NationId: 156, ProvinceId: 11, IspId: 4, IdcId: 1002, Missing: "idc"},
+		{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002, Missing: "idc"},
+	}
+	if resp.Count != 2 || !reflect.DeepEqual(resp.Links, want) {
+		t.Errorf("got %d untranslated links %v, want %v", resp.Count, resp.Links, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"links_manage/db_operation"
+	"sort"
+)
+
+// coverageHealth is the idcs covering a province, or an area kept as a whole,
+// for an isp with those masked by the detectors. The masks are set for the
+// whole province, so the links of an area are never masked.
+type coverageHealth struct {
+	Nation   string `json:"nation"`
+	Province string `json:"province"`
+	Area     string `json:"area,omitempty"`
+	Isp      string `json:"isp"`
+	Idcs     int    `json:"idc_count"`
+	// the idcs with a non zero exception mask, sorted
+	MaskedIdcs  []string `json:"masked_idcs"`
+	HealthyIdcs int      `json:"healthy_count"`
+	// fraction of the idcs masked
+	Impaired float64 `json:"impaired"`
+}
+
+// idcHealth is the provinces and isps covered by an idc, with those where the
+// idc is masked
+type idcHealth struct {
+	Idc             string  `json:"idc"`
+	Coverages       int     `json:"coverage_count"`
+	MaskedCoverages int     `json:"masked_count"`
+	Impaired        float64 `json:"impaired"`
+}
+
+// healthReport is the coverage of the links of a snapshot under the masks
+type healthReport struct {
+	VersionId int64 `json:"version_id"`
+	// covering idcs of all the provinces and isps, and those masked
+	Idcs       int `json:"idc_count"`
+	MaskedIdcs int `json:"masked_count"`
+	// fraction of all the covering idcs masked
+	Impaired float64 `json:"impaired"`
+	// provinces and isps with some idc masked
+	ImpairedCoverages int `json:"impaired_coverages"`
+	// provinces and isps with all their idcs masked
+	DownCoverages int              `json:"down_coverages"`
+	Coverages     []coverageHealth `json:"coverages"`
+	// sorted by idc
+	IdcHealth []idcHealth `json:"idcs"`
+}
+
+func computeHealth(snap *snapshot, masks map[linkdb.DnsCoverLinkIdInfo]int64) *healthReport {
+	// idc name to masked, by coverage
+	idcs := make(map[coverageKey]map[string]bool)
+	for i, link := range snap.linkNameData {
+		key := coverageKey{link.NationName, link.ProvinceName, link.AreaName, link.IspName}
+		if idcs[key] == nil {
+			idcs[key] = make(map[string]bool)
+		}
+		linkId := snap.linkNameIds[i]
+		maskId := linkdb.DnsCoverLinkIdInfo{NationId: linkId.NationId, ProvinceId: linkId.ProvinceId, IspId: linkId.IspId, IdcId: linkId.IdcId}
+		masked := linkId.AreaId == 0 && masks[maskId] != 0
+		idcs[key][link.IdcName] = idcs[key][link.IdcName] || masked
+	}
+	report := &healthReport{VersionId: snap.versionId, Coverages: make([]coverageHealth, 0, len(idcs))}
+	byIdc := make(map[string]*idcHealth)
+	for key, names := range idcs {
+		coverage := coverageHealth{Nation: key.nation, Province: key.province, Area: key.area, Isp: key.isp, Idcs: len(names)}
+		for name, masked := range names {
+			idc := byIdc[name]
+			if idc == nil {
+				idc = &idcHealth{Idc: name}
+				byIdc[name] = idc
+			}
+			idc.Coverages++
+			if masked {
+				idc.MaskedCoverages++
+				coverage.MaskedIdcs = append(coverage.MaskedIdcs, name)
+			}
+		}
+		sort.Strings(coverage.MaskedIdcs)
+		coverage.HealthyIdcs = coverage.Idcs - len(coverage.MaskedIdcs)
+		coverage.Impaired = float64(len(coverage.MaskedIdcs)) / float64(coverage.Idcs)
+		report.Idcs += coverage.Idcs
+		report.MaskedIdcs += len(coverage.MaskedIdcs)
+		if len(coverage.MaskedIdcs) > 0 {
+			report.ImpairedCoverages++
+		}
+		if coverage.HealthyIdcs == 0 {
+			report.DownCoverages++
+		}
+		report.Coverages = append(report.Coverages, coverage)
+	}
+	if report.Idcs > 0 {
+		report.Impaired = float64(report.MaskedIdcs) / float64(report.Idcs)
+	}
+	report.IdcHealth = make([]idcHealth, 0, len(byIdc))
+	for _, idc := range byIdc {
+		idc.Impaired = float64(idc.MaskedCoverages) / float64(idc.Coverages)
+		report.IdcHealth = append(report.IdcHealth, *idc)
+	}
+	sort.Slice(report.IdcHealth, func(i, j int) bool { return report.IdcHealth[i].Idc < report.IdcHealth[j].Idc })
+	sort.Slice(report.Coverages, func(i, j int) bool {
+		a, b := report.Coverages[i], report.Coverages[j]
+		if a.Nation != b.Nation {
+			return a.Nation < b.Nation
+		}
+		if a.Province != b.Province {
+			return a.Province < b.Province
+		}
+		if a.Area != b.Area {
+			return a.Area < b.Area
+		}
+		return a.Isp < b.Isp
+	})
+	return report
+}
+
+// check the current links against the masks in the database, and update the
+// metrics
+func (s *Server) coverageHealth() (*healthReport, error) {
+	masks, err := linkdb.GetLinkMasks(s.db)
+	if err != nil {
+		return nil, err
+	}
+	report := computeHealth(s.snapshot(), masks)
+	setCoverageHealthMetrics(report)
+	return report, nil
+}
+
+// the periodic health check, the alerts are only sent by the leader when the
+// replicas elect one
+func (s *Server) checkHealth() error {
+	report, err := s.coverageHealth()
+	if err != nil {
+		return err
+	}
+	if s.alerter != nil && (!s.conf.Leader.Enabled || s.isLeader()) {
+		s.alerter.evaluate(report)
+	}
+	return nil
+}
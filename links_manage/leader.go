@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/golang/glog"
+	"links_manage/db_operation"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// name of the lease row the replicas compete for
+const leaderLeaseName = "links_manage_leader"
+
+// LeaderConfig of the election among the replicas sharing the database, only
+// the leader runs the singleton jobs while all of them serve the reads
+type LeaderConfig struct {
+	Enabled bool
+	// identity of the replica, hostname:pid when empty
+	Holder        string
+	LeaseDuration time.Duration
+	// period to delete the links restored to mask 0, disabled when zero
+	PurgePeriod time.Duration
+}
+
+func (conf *LeaderConfig) validate() error {
+	if !conf.Enabled {
+		return nil
+	}
+	if conf.LeaseDuration < 3*time.Second {
+		return fmt.Errorf("lease duration must be at least 3 seconds")
+	}
+	if conf.PurgePeriod < 0 {
+		return fmt.Errorf("purge period must not be negative")
+	}
+	return nil
+}
+
+func defaultHolder() string {
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "unknown"
+	}
+	return fmt.Sprintf("%s:%d", hostname, os.Getpid())
+}
+
+// leaderState is what the replica knows of the lease since the last heartbeat
+type leaderState struct {
+	mu      sync.RWMutex
+	lease   *linkdb.Lease
+	leading bool
+	// start of the last heartbeat which renewed the lease, the lease lasts at
+	// least LeaseDuration from then
+	renewedAt time.Time
+	// time of the last successful heartbeat
+	checkTime time.Time
+	// a lease query has not returned yet
+	acquiring bool
+	now       func() time.Time
+}
+
+// the leadership ends once the lease may have expired, even when no heartbeat
+// could tell it, so that no two replicas lead at once
+func (state *leaderState) isLeader(leaseDuration time.Duration) bool {
+	state.mu.RLock()
+	defer state.mu.RUnlock()
+	return state.isLeaderLocked(leaseDuration)
+}
+
+func (state *leaderState) isLeaderLocked(leaseDuration time.Duration) bool {
+	return state.leading && state.now().Before(state.renewedAt.Add(leaseDuration-leaseMargin(leaseDuration)))
+}
+
+// the part of the lease given up for the delays of the query and the clocks
+func leaseMargin(leaseDuration time.Duration) time.Duration {
+	return leaseDuration / 6
+}
+
+func (s *Server) isLeader() bool {
+	return s.leader.isLeader(s.conf.Leader.LeaseDuration)
+}
+
+// run the lease query until ctx is done. The db helper can not cancel a
+// query, so a hung one is left to return on its own and the heartbeats are
+// skipped until it did.
+func (s *Server) acquireLease(ctx context.Context) (*linkdb.Lease, error) {
+	conf := s.conf.Leader
+	s.leader.mu.Lock()
+	if s.leader.acquiring {
+		s.leader.mu.Unlock()
+		return nil, fmt.Errorf("the last lease query has not returned")
+	}
+	s.leader.acquiring = true
+	s.leader.mu.Unlock()
+	type result struct {
+		lease *linkdb.Lease
+		err   error
+	}
+	done := make(chan result, 1)
+	go func() {
+		lease, err := linkdb.AcquireLease(s.db, leaderLeaseName, conf.Holder, conf.LeaseDuration)
+		s.leader.mu.Lock()
+		s.leader.acquiring = false
+		s.leader.mu.Unlock()
+		done <- result{lease, err}
+	}()
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-done:
+		return r.lease, r.err
+	}
+}
+
+// try to take or renew the lease, the leadership is given up at once when the
+// lease can not be confirmed. The query is given half a heartbeat period.
+func (s *Server) heartbeat(ctx context.Context) {
+	conf := s.conf.Leader
+	ctx, cancel := context.WithTimeout(ctx, conf.LeaseDuration/6)
+	defer cancel()
+	start := s.leader.now()
+	lease, err := s.acquireLease(ctx)
+	leading := err == nil && lease != nil && lease.Holder == conf.Holder
+	s.leader.mu.Lock()
+	wasLeading := s.leader.isLeaderLocked(conf.LeaseDuration)
+	s.leader.leading = leading
+	if err == nil {
+		s.leader.lease = lease
+		s.leader.checkTime = s.leader.now()
+	}
+	if leading {
+		s.leader.renewedAt = start
+	}
+	s.leader.mu.Unlock()
+	if err != nil {
+		glog.Errorf("renew leader lease failed: %s", err.Error())
+	}
+	if leading && !wasLeading {
+		glog.Infof("%s becomes the leader", conf.Holder)
+	} else if !leading && wasLeading {
+		glog.Warningf("%s is no longer the leader", conf.Holder)
+	}
+}
+
+// renew the lease 3 times per lease duration, it is released on stop so that
+// another replica takes over at once
+func (s *Server) runLeaderElection() {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		conf := s.conf.Leader
+		ticker := time.NewTicker(conf.LeaseDuration / 3)
+		defer ticker.Stop()
+		for {
+			s.heartbeat(s.ctx)
+			select {
+			case <-s.ctx.Done():
+				if s.isLeader() {
+					if _, err := linkdb.ReleaseLease(s.db, leaderLeaseName, conf.Holder); err != nil {
+						glog.Warningf("release leader lease failed: %s", err.Error())
+					}
+				}
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// run job every period on the leader only, the other replicas skip the ticks
+func (s *Server) runSingleton(name string, period time.Duration, job func() error) {
+	s.runPeriodic(name, period, func() error {
+		if !s.isLeader() {
+			return nil
+		}
+		return job()
+	})
+}
+
+func (s *Server) purgeRestoredLinks() error {
+	rowCount, err := linkdb.DeleteRestoredLink(s.db)
+	if err != nil {
+		return err
+	}
+	glog.Infof("purge %d restored links", rowCount)
+	return nil
+}
+
+func (s *Server) leaderStatusHandler(c *gin.Context) {
+	conf := s.conf.Leader
+	if !conf.Enabled {
+		c.JSON(http.StatusOK, gin.H{"errno": 0, "error": "", "enabled": false})
+		return
+	}
+	s.leader.mu.RLock()
+	defer s.leader.mu.RUnlock()
+	status := gin.H{"errno": 0, "error": "", "enabled": true, "self": conf.Holder, "is_leader": s.leader.isLeaderLocked(conf.LeaseDuration)}
+	if !s.leader.checkTime.IsZero() {
+		status["check_time"] = s.leader.checkTime.Unix()
+	}
+	if lease := s.leader.lease; lease != nil && !lease.Expired {
+		status["leader"] = lease.Holder
+		status["expire_time"] = lease.ExpireTime.Unix()
+	}
+	c.JSON(http.StatusOK, status)
+}
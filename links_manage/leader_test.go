@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"links_manage/db_operation/dbtest"
+)
+
+const acquireLeaseSql = "INSERT INTO link_detect_lease(name, holder, expire_time) VALUES(?, ?, NOW() + INTERVAL ? SECOND)" +
+	" ON DUPLICATE KEY UPDATE" +
+	" holder=IF(holder=VALUES(holder) OR expire_time<NOW(), VALUES(holder), holder)," +
+	" expire_time=IF(holder=VALUES(holder), VALUES(expire_time), expire_time)"
+
+func expectAcquireLease(mock sqlmock.Sqlmock, holder, leader string) {
+	expectAcquireLeaseFor(mock, holder, leader, 30)
+}
+
+func expectAcquireLeaseFor(mock sqlmock.Sqlmock, holder, leader string, seconds int) {
+	mock.ExpectExec(acquireLeaseSql).
+		WithArgs(leaderLeaseName, holder, seconds).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT holder, UNIX_TIMESTAMP(expire_time), expire_time<NOW() FROM link_detect_lease WHERE name=?").
+		WithArgs(leaderLeaseName).
+		WillReturnRows(sqlmock.NewRows([]string{"holder", "expire_time", "expired"}).AddRow(leader, 1700000030, false))
+}
+
+func leaderStatus(t *testing.T, s *Server) map[string]interface{} {
+	t.Helper()
+	w := httptest.NewRecorder()
+	s.Router().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/leader_status", nil))
+	var status map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decode response %s failed: %v", w.Body.String(), err)
+	}
+	return status
+}
+
+func TestLeaderElection(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	db, mock, err := dbtest.New()
+	if err != nil {
+		t.Fatalf("open test db failed: %v", err)
+	}
+	defer db.Close()
+	conf := testConfig()
+	conf.Leader = LeaderConfig{Enabled: true, Holder: "a:1", LeaseDuration: 30 * time.Second}
+	s := newServer(conf, db)
+
+	expectAcquireLease(mock, "a:1", "b:2")
+	s.heartbeat(context.Background())
+	status := leaderStatus(t, s)
+	if s.isLeader() || status["is_leader"] != false || status["leader"] != "b:2" {
+		t.Errorf("a:1 should not lead, status %v", status)
+	}
+
+	expectAcquireLease(mock, "a:1", "a:1")
+	s.heartbeat(context.Background())
+	status = leaderStatus(t, s)
+	if !s.isLeader() || status["is_leader"] != true || status["leader"] != "a:1" || status["expire_time"] != float64(1700000030) {
+		t.Errorf("a:1 should lead, status %v", status)
+	}
+
+	// the leadership is given up when the lease can not be renewed
+	mock.ExpectExec(acquireLeaseSql).
+		WillReturnError(errors.New("connection refused"))
+	s.heartbeat(context.Background())
+	if s.isLeader() {
+		t.Error("a:1 should not lead without renewing the lease")
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeaderLeaseDeadline(t *testing.T) {
+	db, mock, err := dbtest.New()
+	if err != nil {
+		t.Fatalf("open test db failed: %v", err)
+	}
+	defer db.Close()
+	conf := testConfig()
+	conf.Leader = LeaderConfig{Enabled: true, Holder: "a:1", LeaseDuration: 30 * time.Second}
+	s := newServer(conf, db)
+	now := time.Unix(1700000000, 0)
+	s.leader.now = func() time.Time { return now }
+
+	expectAcquireLease(mock, "a:1", "a:1")
+	s.heartbeat(context.Background())
+	// no heartbeat since, the lease may be taken by another replica before
+	// it expires on the clock of mysql
+	now = now.Add(24 * time.Second)
+	if !s.isLeader() {
+		t.Error("a:1 should lead within the lease")
+	}
+	now = now.Add(2 * time.Second)
+	if s.isLeader() {
+		t.Error("a:1 should not lead once the lease may have expired")
+	}
+	if status := leaderStatus(t, s); status["is_leader"] != false {
+		t.Errorf("unexpected status %v", status)
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeaderHeartbeatTimeout(t *testing.T) {
+	db, mock, err := dbtest.New()
+	if err != nil {
+		t.Fatalf("open test db failed: %v", err)
+	}
+	defer db.Close()
+	conf := testConfig()
+	conf.Leader = LeaderConfig{Enabled: true, Holder: "a:1", LeaseDuration: 3 * time.Second}
+	s := newServer(conf, db)
+
+	expectAcquireLeaseFor(mock, "a:1", "a:1", 3)
+	s.heartbeat(context.Background())
+	if !s.isLeader() {
+		t.Fatal("a:1 should lead")
+	}
+
+	// the query hangs longer than the heartbeat timeout of 500ms
+	mock.ExpectExec(acquireLeaseSql).WillDelayFor(time.Second).WillReturnError(errors.New("lock wait timeout"))
+	start := time.Now()
+	s.heartbeat(context.Background())
+	if elapsed := time.Since(start); elapsed > 900*time.Millisecond {
+		t.Errorf("heartbeat returns after %v", elapsed)
+	}
+	if s.isLeader() {
+		t.Error("a:1 should not lead without renewing the lease")
+	}
+	// no second query while the first one hangs
+	s.heartbeat(context.Background())
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		s.leader.mu.RLock()
+		acquiring := s.leader.acquiring
+		s.leader.mu.RUnlock()
+		if !acquiring {
+			break
+		}
+	}
+	if err = mock.ExpectationsWereMet(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLeaderStatusDisabled(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	s := newServer(testConfig(), nil)
+	if status := leaderStatus(t, s); status["enabled"] != false {
+		t.Errorf("unexpected status %v", status)
+	}
+}
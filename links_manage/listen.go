@@ -0,0 +1,158 @@
+package main
+
+import (
+	"common"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const unixSpecPrefix = "unix:"
+
+// where to listen, one of
+//
+//	unix:/path/of/socket
+//	host:port, host is an ip, [ipv6], 0.0.0.0, [::] or an interface name
+//	host, listen on the default port
+type listenSpec struct {
+	// tcp or unix
+	network string
+	// ip or interface name for tcp
+	host string
+	port int
+	// socket file for unix
+	path string
+}
+
+func (spec listenSpec) String() string {
+	if spec.network == "unix" {
+		return unixSpecPrefix + spec.path
+	}
+	return net.JoinHostPort(spec.host, strconv.Itoa(spec.port))
+}
+
+func parseListenSpec(spec string, defaultPort int) (listenSpec, error) {
+	spec = strings.TrimSpace(spec)
+	if strings.HasPrefix(spec, unixSpecPrefix) {
+		path := strings.TrimPrefix(spec, unixSpecPrefix)
+		if path == "" {
+			return listenSpec{}, fmt.Errorf("no socket path in listen spec %s", spec)
+		}
+		return listenSpec{network: "unix", path: path}, nil
+	}
+	if spec == "" {
+		return listenSpec{}, fmt.Errorf("empty listen spec")
+	}
+	// a bare ipv6 address or a host without port
+	if net.ParseIP(spec) != nil || !strings.Contains(spec, ":") {
+		return listenSpec{network: "tcp", host: spec, port: defaultPort}, nil
+	}
+	host, portString, err := net.SplitHostPort(spec)
+	if err != nil {
+		return listenSpec{}, fmt.Errorf("invalid listen spec %s: %s", spec, err.Error())
+	}
+	port, err := strconv.Atoi(portString)
+	if err != nil || port < 0 || port > 65535 {
+		return listenSpec{}, fmt.Errorf("invalid port in listen spec %s", spec)
+	}
+	if host == "" {
+		return listenSpec{}, fmt.Errorf("no host in listen spec %s", spec)
+	}
+	return listenSpec{network: "tcp", host: host, port: port}, nil
+}
+
+func parseListenSpecs(specs []string, defaultPort int) ([]listenSpec, error) {
+	var result []listenSpec
+	for _, spec := range specs {
+		listenSpec, err := parseListenSpec(spec, defaultPort)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, listenSpec)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("nothing to listen on")
+	}
+	return result, nil
+}
+
+func (spec listenSpec) listen() (net.Listener, error) {
+	if spec.network == "unix" {
+		if err := removeStaleSocket(spec.path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", spec.path)
+	}
+	host := spec.host
+	if net.ParseIP(host) == nil {
+		ip, err := common.GetIPByInterfaceName(host)
+		if err != nil {
+			return nil, fmt.Errorf("get ip address of %s failed: %s", host, err.Error())
+		}
+		host = ip.String()
+	}
+	return net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(spec.port)))
+}
+
+// remove the socket left by a killed server, a socket still accepting
+// connections belongs to a running server and is kept
+func removeStaleSocket(path string) error {
+	info, err := os.Stat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil
+	}
+	conn, err := net.DialTimeout("unix", path, time.Second)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("socket %s is in use by a running server", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return nil
+	}
+	return os.Remove(path)
+}
+
+// listen on all the specs, nothing is left open on failure
+func listenAll(specs []listenSpec) ([]net.Listener, error) {
+	var listeners []net.Listener
+	for _, spec := range specs {
+		listener, err := spec.listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return nil, fmt.Errorf("listen on %s failed: %s", spec, err.Error())
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// serve on all the listeners, the errors other than http.ErrServerClosed are
+// sent to the returned channel
+func serveAll(httpServer *http.Server, listeners []net.Listener) <-chan error {
+	errChan := make(chan error, len(listeners))
+	// decide before serving, Serve fills TLSConfig for http2 on its own
+	useTLS := httpServer.TLSConfig != nil
+	for _, listener := range listeners {
+		go func(listener net.Listener) {
+			var err error
+			if useTLS {
+				// the key pair is already in TLSConfig
+				err = httpServer.ServeTLS(listener, "", "")
+			} else {
+				err = httpServer.Serve(listener)
+			}
+			if err != http.ErrServerClosed {
+				errChan <- fmt.Errorf("serve on %s failed: %s", listener.Addr(), err.Error())
+			}
+		}(listener)
+	}
+	return errChan
+}
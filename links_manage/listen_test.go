@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseListenSpec(t *testing.T) {
+	valid := map[string]listenSpec{
+		"eth1":             {network: "tcp", host: "eth1", port: 12365},
+		"eth1:8080":        {network: "tcp", host: "eth1", port: 8080},
+		"10.0.0.1:8080":    {network: "tcp", host: "10.0.0.1", port: 8080},
+		"0.0.0.0":          {network: "tcp", host: "0.0.0.0", port: 12365},
+		"::":               {network: "tcp", host: "::", port: 12365},
+		"[::]:8080":        {network: "tcp", host: "::", port: 8080},
+		"[fe80::1]:8080":   {network: "tcp", host: "fe80::1", port: 8080},
+		" 127.0.0.1:80 ":   {network: "tcp", host: "127.0.0.1", port: 80},
+		"unix:/run/l.sock": {network: "unix", path: "/run/l.sock"},
+	}
+	for spec, want := range valid {
+		got, err := parseListenSpec(spec, 12365)
+		if err != nil {
+			t.Errorf("parse %q failed: %v", spec, err)
+		} else if got != want {
+			t.Errorf("parse %q got %+v, want %+v", spec, got, want)
+		}
+	}
+	for _, spec := range []string{"", "unix:", "10.0.0.1:http", ":8080", "10.0.0.1:70000", "[::1"} {
+		if _, err := parseListenSpec(spec, 12365); err == nil {
+			t.Errorf("parse %q should fail", spec)
+		}
+	}
+	if _, err := parseListenSpecs(nil, 12365); err == nil {
+		t.Error("parse no spec should fail")
+	}
+}
+
+func TestServeAll(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "links.sock")
+	specs, err := parseListenSpecs([]string{"127.0.0.1:0", "unix:" + socket}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listeners, err := listenAll(specs)
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	httpServer := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	serveAll(httpServer, listeners)
+	defer httpServer.Shutdown(context.Background())
+
+	tcpClient := &http.Client{}
+	unixClient := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", socket)
+		},
+	}}
+	for client, url := range map[*http.Client]string{
+		tcpClient:  "http://" + listeners[0].Addr().String(),
+		unixClient: "http://unix",
+	} {
+		resp, err := client.Get(url)
+		if err != nil {
+			t.Errorf("get %s failed: %v", url, err)
+			continue
+		}
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if string(body) != "ok" {
+			t.Errorf("get %s return %q", url, body)
+		}
+	}
+}
+
+func TestListenUnixSocketInUse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "listen_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	socket := filepath.Join(dir, "links.sock")
+	spec := listenSpec{network: "unix", path: socket}
+
+	live, err := spec.listen()
+	if err != nil {
+		t.Fatalf("listen failed: %v", err)
+	}
+	if _, err = spec.listen(); err == nil {
+		t.Error("listen on the socket of a running server should fail")
+	}
+	// the running server keeps its socket
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		t.Fatalf("dial the running server failed: %v", err)
+	}
+	conn.Close()
+
+	// a killed server leaves its socket behind
+	live.(*net.UnixListener).SetUnlinkOnClose(false)
+	live.Close()
+	stale, err := spec.listen()
+	if err != nil {
+		t.Fatalf("listen on a stale socket failed: %v", err)
+	}
+	stale.Close()
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"expvar"
+	"links_manage/dnslink"
+)
+
+// the metrics are served by expvar on /debug/vars
+var (
+	// conflicts of each dictionary found by the last refresh
+	dictConflictsMetric = expvar.NewMap("dict_conflicts")
+	// clusters left out of the geo and idc dictionaries by the last refresh
+	// as none of their oss answered
+	dictMissingClustersMetric = expvar.NewMap("dict_missing_clusters")
+	// links of the current snapshot without name, by the missing dimension
+	untranslatedLinksMetric = expvar.NewMap("untranslated_links")
+	// cover entries of the current links with a weight which is not a number
+	badWeightsMetric = expvar.NewInt("bad_weights")
+	// areas of the clusters found by the last link refresh, by how they are
+	// expanded
+	areaExpansionsMetric = expvar.NewMap("area_expansions")
+	// provinces and isps of the current links covered by a single idc
+	singlePointCoverageMetric = expvar.NewInt("single_point_coverage")
+	// covering idcs of the current links and those masked by the detectors,
+	// by the last health check
+	coverageHealthMetric = expvar.NewMap("coverage_health")
+)
+
+// set the conflict count of the dicts, those without conflicts are set to 0
+func setDictConflictMetrics(conflicts []dnslink.DictConflict, dicts ...string) {
+	counts := make(map[string]int64)
+	for _, conflict := range conflicts {
+		counts[conflict.Dict]++
+	}
+	for _, dict := range dicts {
+		count := new(expvar.Int)
+		count.Set(counts[dict])
+		dictConflictsMetric.Set(dict, count)
+	}
+}
+
+func setDictMissingClusterMetric(dict string, missing []string) {
+	count := new(expvar.Int)
+	count.Set(int64(len(missing)))
+	dictMissingClustersMetric.Set(dict, count)
+}
+
+func setUntranslatedLinkMetrics(links []untranslatedLink) {
+	counts := make(map[string]int64)
+	for _, link := range links {
+		counts[link.Missing]++
+	}
+	for _, dimension := range []string{"nation", "province", "city", "area", "isp", "idc"} {
+		count := new(expvar.Int)
+		count.Set(counts[dimension])
+		untranslatedLinksMetric.Set(dimension, count)
+	}
+}
+
+func setAreaExpansionMetrics(expansions []dnslink.AreaExpansion) {
+	counts := make(map[string]int64)
+	for _, expansion := range expansions {
+		counts[expansion.Mode]++
+	}
+	for _, mode := range []string{dnslink.AreaModeProvinces, dnslink.AreaModeKept, dnslink.AreaModeUnknown} {
+		count := new(expvar.Int)
+		count.Set(counts[mode])
+		areaExpansionsMetric.Set(mode, count)
+	}
+}
+
+func setRedundancyMetrics(coverages []coverageRedundancy) {
+	var singlePoints int64
+	for _, coverage := range coverages {
+		if coverage.SinglePoint {
+			singlePoints++
+		}
+	}
+	singlePointCoverageMetric.Set(singlePoints)
+}
+
+func setCoverageHealthMetrics(report *healthReport) {
+	for name, value := range map[string]int64{
+		"idcs":               int64(report.Idcs),
+		"masked_idcs":        int64(report.MaskedIdcs),
+		"impaired_coverages": int64(report.ImpairedCoverages),
+		"down_coverages":     int64(report.DownCoverages),
+	} {
+		count := new(expvar.Int)
+		count.Set(value)
+		coverageHealthMetric.Set(name, count)
+	}
+	impaired := new(expvar.Float)
+	impaired.Set(report.Impaired)
+	coverageHealthMetric.Set("impaired", impaired)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"links_manage/db_operation"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// coverageRedundancy is the idcs covering a province, or an area kept as a
+// whole, for an isp. The links of the cities are counted for their province.
+type coverageRedundancy struct {
+	Nation   string `json:"nation"`
+	Province string `json:"province"`
+	Area     string `json:"area,omitempty"`
+	Isp      string `json:"isp"`
+	// the distinct idcs, sorted
+	Idcs     []string `json:"idcs"`
+	IdcCount int      `json:"idc_count"`
+	// covered by a single idc, which is a single point of failure
+	SinglePoint bool `json:"single_point"`
+}
+
+type coverageKey struct {
+	nation, province, area, isp string
+}
+
+// the coverage of every province and isp of the named links, sorted by names
+func computeRedundancy(links []linkdb.DnsCoverLinkNameInfo) []coverageRedundancy {
+	idcs := make(map[coverageKey]map[string]bool)
+	for _, link := range links {
+		key := coverageKey{link.NationName, link.ProvinceName, link.AreaName, link.IspName}
+		if idcs[key] == nil {
+			idcs[key] = make(map[string]bool)
+		}
+		idcs[key][link.IdcName] = true
+	}
+	result := make([]coverageRedundancy, 0, len(idcs))
+	for key, names := range idcs {
+		coverage := coverageRedundancy{Nation: key.nation, Province: key.province, Area: key.area, Isp: key.isp}
+		for name := range names {
+			coverage.Idcs = append(coverage.Idcs, name)
+		}
+		sort.Strings(coverage.Idcs)
+		coverage.IdcCount = len(coverage.Idcs)
+		coverage.SinglePoint = coverage.IdcCount == 1
+		result = append(result, coverage)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.Nation != b.Nation {
+			return a.Nation < b.Nation
+		}
+		if a.Province != b.Province {
+			return a.Province < b.Province
+		}
+		if a.Area != b.Area {
+			return a.Area < b.Area
+		}
+		return a.Isp < b.Isp
+	})
+	return result
+}
+
+// the rows of the csv export, with a header
+func redundancyRecords(coverages []coverageRedundancy) [][]string {
+	records := [][]string{{"nation", "province", "area", "isp", "idc_count", "single_point", "idcs"}}
+	for _, coverage := range coverages {
+		singlePoint := "0"
+		if coverage.SinglePoint {
+			singlePoint = "1"
+		}
+		records = append(records, []string{coverage.Nation, coverage.Province, coverage.Area, coverage.Isp,
+			strconv.Itoa(coverage.IdcCount), singlePoint, strings.Join(coverage.Idcs, ";")})
+	}
+	return records
+}
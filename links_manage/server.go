@@ -0,0 +1,313 @@
+package main
+
+import (
+	"common"
+	"context"
+	"fmt"
+	"github.com/golang/glog"
+	"io"
+	"links_manage/db_operation"
+	"links_manage/dnslink"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server serves the detect links of the concerned clusters. The links, geo
+// and idc dictionaries are loaded by Start and refreshed in background until
+// Stop is called.
+type Server struct {
+	conf      *Config
+	db        linkdb.DB
+	newSource func(conf *RefreshConfig) dnslink.OssSource
+
+	refreshConf atomic.Value
+	// signalled to recompute the links at once
+	linkRefreshChan chan struct{}
+	// tickers of the refresh goroutines, reset when the periods change
+	geoTicker, idcTicker, linkTicker *time.Ticker
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// the current *snapshot, updateMu serializes the refreshes building the
+	// next one
+	snap     atomic.Value
+	updateMu sync.Mutex
+
+	leader leaderState
+	// nil when no alert webhook is configured
+	alerter *alerter
+	// nil when no webhook subscriber is configured
+	webhooks *webhookDispatcher
+}
+
+// NewServer connects the database of conf, nothing is loaded until Start
+func NewServer(conf *Config) (*Server, error) {
+	dbHelper := common.InitDBHelper(common.NewDBConf(conf.DB.Host, conf.DB.Db, conf.DB.User, conf.DB.Passwd,
+		conf.DB.Charset, conf.DB.Port, conf.DB.MaxOpenConns, conf.DB.MaxIdleConns, conf.DB.MaxLifeTime))
+	if dbHelper == nil {
+		return nil, fmt.Errorf("init DB helper failed")
+	}
+	return newServer(conf, dbHelper), nil
+}
+
+func newServer(conf *Config, db linkdb.DB) *Server {
+	s := &Server{
+		conf:            conf,
+		db:              db,
+		linkRefreshChan: make(chan struct{}, 1),
+	}
+	s.leader.now = time.Now
+	s.newSource = func(conf *RefreshConfig) dnslink.OssSource {
+		return dnslink.NewCgiSource(conf.CgiUser, conf.CgiTimeout)
+	}
+	if len(conf.Alert.Webhooks) > 0 {
+		s.alerter = newAlerter(&conf.Alert, &conf.Webhooks)
+	}
+	if len(conf.Webhooks.Subscribers) > 0 {
+		s.webhooks = newWebhookDispatcher(&conf.Webhooks)
+	}
+	refreshConf := conf.RefreshConfig
+	s.setRefreshConfig(&refreshConf)
+	s.snap.Store(&snapshot{})
+	return s
+}
+
+func (s *Server) snapshot() *snapshot {
+	return s.snap.Load().(*snapshot)
+}
+
+// build the next snapshot from a copy of the current one, the names and the
+// version are recomputed after modify. A new version is told to the webhooks
+// once the links are loaded, whether the links or a dictionary changed.
+func (s *Server) updateSnapshot(modify func(snap *snapshot)) *snapshot {
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	last := s.snapshot()
+	next := *last
+	modify(&next)
+	next.computeNames()
+	setUntranslatedLinkMetrics(next.untranslatedLinks)
+	if next.versionId != last.versionId {
+		next.redundancy = computeRedundancy(next.linkNameData)
+		setRedundancyMetrics(next.redundancy)
+	}
+	s.snap.Store(&next)
+	// all the replicas see the change, only the leader tells it when they
+	// elect one
+	if s.webhooks != nil && next.linkIdData != nil && next.versionId != last.versionId && (!s.conf.Leader.Enabled || s.isLeader()) {
+		s.webhooks.emit(eventLinksChanged, &linksChangedData{
+			VersionId:         next.versionId,
+			PreviousVersionId: last.versionId,
+			LinkCount:         len(next.linkNameData),
+		})
+	}
+	return &next
+}
+
+func (s *Server) refreshConfig() *RefreshConfig {
+	return s.refreshConf.Load().(*RefreshConfig)
+}
+
+func (s *Server) setRefreshConfig(conf *RefreshConfig) {
+	s.refreshConf.Store(conf)
+}
+
+func (s *Server) triggerLinkRefresh() {
+	select {
+	case s.linkRefreshChan <- struct{}{}:
+	default:
+	}
+}
+
+// the dispatcher of the alerts, nil without alerter
+func (s *Server) alertWebhooks() *webhookDispatcher {
+	if s.alerter == nil {
+		return nil
+	}
+	return s.alerter.webhooks
+}
+
+// Start loads the geo, idc and link data, and starts to refresh them. Stop
+// must be called once Start returns nil.
+func (s *Server) Start() error {
+	s.ctx, s.cancel = context.WithCancel(context.Background())
+	for _, webhooks := range []*webhookDispatcher{s.webhooks, s.alertWebhooks()} {
+		if webhooks == nil {
+			continue
+		}
+		s.wg.Add(1)
+		go func(webhooks *webhookDispatcher) {
+			defer s.wg.Done()
+			webhooks.run(s.ctx)
+		}(webhooks)
+	}
+	// the concerned clusters are read again on every refresh
+	ossDbs, err := linkdb.GetClusterOssIps(s.db)
+	if err != nil {
+		s.cancel()
+		return fmt.Errorf("get cluster oss ip failed: %s", err.Error())
+	}
+	if err = s.updateGeoInfo(ossDbs); err != nil {
+		s.cancel()
+		return fmt.Errorf("load geo info failed: %s", err.Error())
+	}
+	if err = s.updateIdcInfo(ossDbs); err != nil {
+		s.cancel()
+		return fmt.Errorf("load idc info failed: %s", err.Error())
+	}
+	if err = s.updateLinkData(ossDbs); err != nil {
+		s.cancel()
+		return fmt.Errorf("init link data failed: %s", err.Error())
+	}
+
+	conf := s.refreshConfig()
+	s.geoTicker = time.NewTicker(conf.GeoUpdatePeriod)
+	s.idcTicker = time.NewTicker(conf.IdcUpdatePeriod)
+	s.linkTicker = time.NewTicker(conf.LinkUpdatePeriod)
+	s.runRefresh("geo info", s.geoTicker.C, nil, s.updateGeoInfo)
+	s.runRefresh("idc info", s.idcTicker.C, nil, s.updateIdcInfo)
+	// links are also recomputed at once when the valid ids changed
+	s.runRefresh("link data", s.linkTicker.C, s.linkRefreshChan, s.updateLinkData)
+	if s.conf.HealthPeriod > 0 {
+		s.runPeriodic("coverage health", s.conf.HealthPeriod, s.checkHealth)
+	}
+	if s.conf.Leader.Enabled {
+		s.runLeaderElection()
+		if s.conf.Leader.PurgePeriod > 0 {
+			s.runSingleton("purge restored links", s.conf.Leader.PurgePeriod, s.purgeRestoredLinks)
+		}
+	}
+	if s.conf.ConfigFile != "" {
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.watchConfig()
+		}()
+	}
+	return nil
+}
+
+// Stop cancels the refreshes in flight, waits for the refresh goroutines and
+// closes the database. The requests using the server must be drained before.
+func (s *Server) Stop() {
+	s.cancel()
+	s.geoTicker.Stop()
+	s.idcTicker.Stop()
+	s.linkTicker.Stop()
+	s.wg.Wait()
+	closer, ok := s.db.(io.Closer)
+	if !ok {
+		glog.Warningf("db %T cannot be closed, its connections are left open", s.db)
+		return
+	}
+	if err := closer.Close(); err != nil {
+		glog.Warningf("close db failed: %s", err.Error())
+	}
+}
+
+// run job every period until the server stops
+func (s *Server) runPeriodic(name string, period time.Duration, job func() error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(period)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := job(); err != nil {
+				glog.Errorf("run %s failed: %s", name, err.Error())
+			}
+		}
+	}()
+}
+
+// run update on every tick or refresh signal until the server stops
+func (s *Server) runRefresh(name string, tick <-chan time.Time, refresh <-chan struct{}, update func(ossDbs []linkdb.OssDb) error) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		for {
+			select {
+			case <-s.ctx.Done():
+				return
+			case <-tick:
+			case <-refresh:
+			}
+			ossDbs, err := linkdb.GetClusterOssIps(s.db)
+			if err != nil {
+				glog.Errorf("update %s failed for get cluster oss ip failed", name)
+				continue
+			}
+			if err = update(ossDbs); err != nil {
+				glog.Errorf("update %s failed: %s", name, err.Error())
+			}
+		}
+	}()
+}
+
+func (s *Server) updateGeoInfo(ossDbs []linkdb.OssDb) error {
+	conf := s.refreshConfig()
+	ctx, cancel := context.WithTimeout(s.ctx, conf.RefreshTimeout)
+	defer cancel()
+	newGeoInfo, conflicts, missing, err := dnslink.LoadGeoInfoMap(ctx, s.newSource(conf), ossDbs)
+	if err != nil {
+		return err
+	}
+	setDictConflictMetrics(conflicts, "nation", "province", "isp")
+	setDictMissingClusterMetric("geo", missing)
+	s.updateSnapshot(func(snap *snapshot) {
+		snap.geoInfo = newGeoInfo
+		snap.geoConflicts = conflicts
+		snap.geoMissing = missing
+	})
+	return nil
+}
+
+func (s *Server) updateIdcInfo(ossDbs []linkdb.OssDb) error {
+	conf := s.refreshConfig()
+	ctx, cancel := context.WithTimeout(s.ctx, conf.RefreshTimeout)
+	defer cancel()
+	newIdcInfo, conflicts, missing, err := dnslink.LoadIdcInfoMapFromCgi(ctx, s.newSource(conf), ossDbs)
+	if err != nil {
+		return err
+	}
+	setDictConflictMetrics(conflicts, "idc")
+	setDictMissingClusterMetric("idc", missing)
+	s.updateSnapshot(func(snap *snapshot) {
+		snap.idcInfo = newIdcInfo
+		snap.idcConflicts = conflicts
+		snap.idcMissing = missing
+	})
+	return nil
+}
+
+func (s *Server) updateLinkData(ossDbs []linkdb.OssDb) error {
+	conf := s.refreshConfig()
+	ctx, cancel := context.WithTimeout(s.ctx, conf.RefreshTimeout)
+	defer cancel()
+	currentLinkData, areaExpansions, err := dnslink.GetAllLinks(ctx, s.newSource(conf), ossDbs, dnslink.LinkOptions{
+		ValidIspIds:    conf.ValidIspIds,
+		ValidNationIds: conf.ValidNationIds,
+		CityNationIds:  conf.CityNationIds,
+		AreaNationIds:  conf.AreaNationIds,
+	})
+	if err != nil {
+		return err
+	}
+	badWeights := collectBadWeights(currentLinkData)
+	badWeightsMetric.Set(int64(len(badWeights)))
+	setAreaExpansionMetrics(areaExpansions)
+	s.updateSnapshot(func(snap *snapshot) {
+		snap.linkIdData = currentLinkData
+		snap.badWeights = badWeights
+		snap.areaExpansions = areaExpansions
+	})
+	return nil
+}
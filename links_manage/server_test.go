@@ -0,0 +1,235 @@
+package main
+
+import (
+	"common"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"links_manage/db_operation"
+	"links_manage/db_operation/dbtest"
+	"links_manage/dnslink"
+	"links_manage/dnslink/osstest"
+)
+
+func testConfig() *Config {
+	return &Config{RefreshConfig: RefreshConfig{
+		ValidIspIds:      map[int64]bool{1: true, 2: true, 4: true},
+		ValidNationIds:   map[int64]bool{156: true},
+		LinkUpdatePeriod: time.Hour,
+		IdcUpdatePeriod:  time.Hour,
+		GeoUpdatePeriod:  time.Hour,
+		RefreshTimeout:   5 * time.Second,
+		CgiUser:          "test",
+		CgiTimeout:       2 * time.Second,
+	}}
+}
+
+// expect the cluster list read by Server.Start, the only cluster is the fake oss
+func expectClusterOssIps(mock sqlmock.Sqlmock, ossAddr string) {
+	mock.ExpectQuery("SELECT cluster_id FROM link_detect_cluster").
+		WillReturnRows(sqlmock.NewRows([]string{"cluster_id"}).AddRow(1))
+	mock.ExpectQuery("SELECT id, db, slave_db FROM cluster_info").
+		WillReturnRows(sqlmock.NewRows([]string{"id", "db", "slave_db"}).AddRow(1, ossAddr, ossAddr))
+}
+
+// start a server on a fake oss and an in-process database
+func startTestServer(t *testing.T, conf *Config) (*Server, *osstest.Server, sqlmock.Sqlmock) {
+	t.Helper()
+	oss := osstest.NewDefaultServer()
+	t.Cleanup(oss.Close)
+	s, mock := startTestServerOn(t, conf, oss)
+	return s, oss, mock
+}
+
+func startTestServerOn(t *testing.T, conf *Config, oss *osstest.Server) (*Server, sqlmock.Sqlmock) {
+	t.Helper()
+	db, mock, err := dbtest.New()
+	if err != nil {
+		t.Fatalf("open test db failed: %v", err)
+	}
+	expectClusterOssIps(mock, oss.Addr)
+
+	s := newServer(conf, db)
+	if err = s.Start(); err != nil {
+		db.Close()
+		t.Fatalf("start server failed: %v", err)
+	}
+	// the database is closed by Stop
+	t.Cleanup(func() {
+		mock.ExpectClose()
+		s.Stop()
+	})
+	return s, mock
+}
+
+func (s *Server) linkCount() int {
+	return len(s.snapshot().linkNameData)
+}
+
+// the helper made by NewServer has its connections closed by Stop
+func TestStopClosesDBHelper(t *testing.T) {
+	var db linkdb.DB = (*common.DBHelper)(nil)
+	if _, ok := db.(io.Closer); !ok {
+		t.Errorf("%T is not closed by Stop", db)
+	}
+}
+
+func TestServerStartFailed(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	oss.SetFault(osstest.IdcQueryCgi, osstest.Fault{Errno: 1})
+	db, mock, err := dbtest.New()
+	if err != nil {
+		t.Fatalf("open test db failed: %v", err)
+	}
+	defer db.Close()
+	expectClusterOssIps(mock, oss.Addr)
+
+	if err = newServer(testConfig(), db).Start(); err == nil {
+		t.Error("start server should fail")
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	telecomConf := testConfig()
+	telecomConf.ValidIspIds = map[int64]bool{1: true}
+	telecom, _, _ := startTestServer(t, telecomConf)
+	all, _, _ := startTestServer(t, testConfig())
+
+	if n := telecom.linkCount(); n != 2 {
+		t.Errorf("telecom server has %d links, want 2", n)
+	}
+	if n := all.linkCount(); n != 5 {
+		t.Errorf("server has %d links, want 5", n)
+	}
+}
+
+func (s *Server) versionId() int64 {
+	return s.snapshot().versionId
+}
+
+func linkVersion(links dnslink.Links) int64 {
+	snap := snapshot{linkIdData: links}
+	snap.computeNames()
+	return snap.versionId
+}
+
+func TestLinkDataVersion(t *testing.T) {
+	a := linkdb.DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 11, IspId: 1, IdcId: 1001}
+	b := linkdb.DnsCoverLinkIdInfo{NationId: 156, ProvinceId: 44, IspId: 2, IdcId: 1002}
+	// the same links inserted in another order
+	ab := dnslink.Links{a: {}, b: {}}
+	ba := make(dnslink.Links)
+	ba[b] = &dnslink.LinkDetail{}
+	ba[a] = &dnslink.LinkDetail{}
+	if linkVersion(ab) != linkVersion(ba) {
+		t.Error("the same links have different versions")
+	}
+	if linkVersion(ab) == linkVersion(dnslink.Links{a: {}}) {
+		t.Error("different links have the same version")
+	}
+	// the details of the links are served too
+	source := dnslink.LinkSource{OssIp: "10.0.0.1", ResId: 1, ResGroupId: 2, Priority: 1, Weight: 10}
+	ip := dnslink.LinkIp{Ip: "1.1.1.1", Vip: "2.2.2.2"}
+	detail := dnslink.LinkDetail{Sources: []dnslink.LinkSource{source}, Ips: []dnslink.LinkIp{ip}, Priority: 1, Weight: 10}
+	base := linkVersion(dnslink.Links{a: &detail})
+	reordered := detail
+	reordered.Ips = []dnslink.LinkIp{{Ip: "3.3.3.3"}, ip}
+	swapped := detail
+	swapped.Ips = []dnslink.LinkIp{ip, {Ip: "3.3.3.3"}}
+	if linkVersion(dnslink.Links{a: &reordered}) != linkVersion(dnslink.Links{a: &swapped}) {
+		t.Error("the same ips in another order have different versions")
+	}
+	// the same covers from other osses
+	other := source
+	other.ResGroupId = 3
+	fromOss := func(ossIps ...string) int64 {
+		sources := []dnslink.LinkSource{source, other}
+		for i := range sources {
+			sources[i].OssIp = ossIps[i]
+		}
+		return linkVersion(dnslink.Links{a: {Sources: sources, Ips: detail.Ips, Priority: 1, Weight: 20}})
+	}
+	if fromOss("10.0.0.1", "10.0.0.2") != fromOss("10.0.0.4", "10.0.0.3") {
+		t.Error("the same covers from other osses have different versions")
+	}
+	weighted := source
+	weighted.Weight = 20
+	for name, changed := range map[string]dnslink.LinkDetail{
+		"priority": {Sources: detail.Sources, Ips: detail.Ips, Priority: 2, Weight: 10},
+		"weight":   {Sources: detail.Sources, Ips: detail.Ips, Priority: 1, Weight: 20},
+		"ips":      {Sources: detail.Sources, Ips: []dnslink.LinkIp{{Ip: "1.1.1.1", Vip: "3.3.3.3"}}, Priority: 1, Weight: 10},
+		"sources":  {Sources: []dnslink.LinkSource{weighted}, Ips: detail.Ips, Priority: 1, Weight: 10},
+	} {
+		changed := changed
+		if linkVersion(dnslink.Links{a: &changed}) == base {
+			t.Errorf("version is not changed with the %s", name)
+		}
+	}
+	for _, links := range []dnslink.Links{nil, ab} {
+		v := linkVersion(links)
+		if v <= 0 {
+			t.Errorf("version %d is not positive", v)
+		}
+		if v >= 1<<53 || int64(float64(v)) != v {
+			t.Errorf("version %d is not exact as a double", v)
+		}
+	}
+}
+
+func TestReplicasAgreeOnVersion(t *testing.T) {
+	// every replica asks an oss of its own
+	a, _, _ := startTestServer(t, testConfig())
+	b, _, _ := startTestServer(t, testConfig())
+	if a.versionId() != b.versionId() {
+		t.Errorf("replicas got version %d and %d for the same links", a.versionId(), b.versionId())
+	}
+}
+
+func TestServerRefreshLinks(t *testing.T) {
+	s, oss, mock := startTestServer(t, testConfig())
+	oldVersionId := s.versionId()
+
+	newConf := *s.refreshConfig()
+	newConf.ValidIspIds = map[int64]bool{1: true}
+	s.setRefreshConfig(&newConf)
+	// the cluster list is read again for the refresh
+	expectClusterOssIps(mock, oss.Addr)
+	s.triggerLinkRefresh()
+	deadline := time.Now().Add(5 * time.Second)
+	for s.linkCount() != 2 {
+		if time.Now().After(deadline) {
+			t.Fatalf("server has %d links after refresh, want 2", s.linkCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if s.versionId() == oldVersionId {
+		t.Error("version is not changed with the links")
+	}
+}
+
+func TestDictRefreshRenamesLinks(t *testing.T) {
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	// gz-idc-1 is not known yet, 2 of the 5 links have no name
+	oss.SetFixture("idc_query.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"id": 1001, "idcName": "bj-idc-1"}]}`)
+	s, _ := startTestServerOn(t, testConfig(), oss)
+	if n := s.linkCount(); n != 3 {
+		t.Fatalf("server has %d links, want 3", n)
+	}
+	oldVersionId := s.versionId()
+
+	oss.SetFixture("idc_query.json", `{"errno": 0, "error": "", "seq": 1, "data": [
+		{"id": 1001, "idcName": "bj-idc-1"}, {"id": 1002, "idcName": "gz-idc-1"}]}`)
+	if err := s.updateIdcInfo([]linkdb.OssDb{{Master: oss.Addr, Slaver: oss.Addr}}); err != nil {
+		t.Fatalf("update idc info failed: %v", err)
+	}
+	if n := s.linkCount(); n != 5 {
+		t.Errorf("server has %d links after idc refresh, want 5", n)
+	}
+	if s.versionId() == oldVersionId {
+		t.Error("version is not changed with the names")
+	}
+}
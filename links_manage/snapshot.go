@@ -0,0 +1,235 @@
+package main
+
+import (
+	"common"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"links_manage/db_operation"
+	"links_manage/dnslink"
+	"math"
+	"sort"
+)
+
+// snapshot is the data served at a time. A refresh builds a new snapshot from
+// the last one and swaps it in as a whole, so the readers always see the
+// links named by the dictionaries they are served with. A snapshot must not
+// be modified once stored.
+type snapshot struct {
+	// hash of the links, their details and names, the same on all the replicas and
+	// across restarts
+	versionId int64
+
+	// the dictionaries merged from the clusters, with the conflicts found and
+	// the masters of the clusters which did not answer
+	geoInfo      *common.GeoInfo
+	geoConflicts []dnslink.DictConflict
+	geoMissing   []string
+	idcInfo      *dnslink.IdcIdNameMap
+	idcConflicts []dnslink.DictConflict
+	idcMissing   []string
+
+	linkIdData dnslink.Links
+	// names of linkIdData in the order of ids, the links without names in
+	// the dictionaries are left out and kept in untranslatedLinks
+	linkNameData []linkdb.DnsCoverLinkNameInfo
+	// ids of linkNameData, one by one
+	linkNameIds       []linkdb.DnsCoverLinkIdInfo
+	untranslatedLinks []untranslatedLink
+	// cover entries of linkIdData with a weight which is not a number
+	badWeights []badWeight
+	// how the areas of the covers of linkIdData are expanded
+	areaExpansions []dnslink.AreaExpansion
+	// idcs covering each province and isp of linkNameData, recomputed when
+	// the version changes
+	redundancy []coverageRedundancy
+}
+
+// badWeight is a cover entry with a weight which is not a number
+type badWeight struct {
+	OssIp      string `json:"oss"`
+	ResId      int64  `json:"res_id"`
+	ResGroupId int64  `json:"resgrp_id"`
+	Weight     string `json:"weight"`
+}
+
+// the bad weights of the sources of links, a cover entry is reported once
+func collectBadWeights(links dnslink.Links) []badWeight {
+	found := make(map[badWeight]bool)
+	var result []badWeight
+	for _, detail := range links {
+		for _, source := range detail.Sources {
+			if !source.WeightError {
+				continue
+			}
+			bad := badWeight{OssIp: source.OssIp, ResId: source.ResId, ResGroupId: source.ResGroupId, Weight: source.BadWeight}
+			if !found[bad] {
+				found[bad] = true
+				result = append(result, bad)
+			}
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		if a.OssIp != b.OssIp {
+			return a.OssIp < b.OssIp
+		}
+		if a.ResId != b.ResId {
+			return a.ResId < b.ResId
+		}
+		return a.ResGroupId < b.ResGroupId
+	})
+	return result
+}
+
+// untranslatedLink is a link not served for a dimension without name
+type untranslatedLink struct {
+	NationId   int64 `json:"nation_id"`
+	ProvinceId int64 `json:"province_id"`
+	CityId     int64 `json:"city_id,omitempty"`
+	AreaId     int64 `json:"area_id,omitempty"`
+	IspId      int64 `json:"isp_id"`
+	IdcId      int64 `json:"idc_id"`
+	// nation, province, city, area, isp or idc
+	Missing string `json:"missing"`
+}
+
+// rebuild the names and the version after the links or a dictionary changed
+func (snap *snapshot) computeNames() {
+	sortedLinks := sortLinks(snap.linkIdData)
+	snap.linkNameData = nil
+	snap.linkNameIds = nil
+	snap.untranslatedLinks = nil
+	h := sha256.New()
+	buf := make([]byte, 48)
+	for _, link := range sortedLinks {
+		binary.BigEndian.PutUint64(buf[0:], uint64(link.NationId))
+		binary.BigEndian.PutUint64(buf[8:], uint64(link.ProvinceId))
+		binary.BigEndian.PutUint64(buf[16:], uint64(link.CityId))
+		binary.BigEndian.PutUint64(buf[24:], uint64(link.AreaId))
+		binary.BigEndian.PutUint64(buf[32:], uint64(link.IspId))
+		binary.BigEndian.PutUint64(buf[40:], uint64(link.IdcId))
+		h.Write(buf)
+		hashDetail(h, snap.linkIdData[link])
+		if snap.geoInfo == nil || snap.idcInfo == nil {
+			h.Write([]byte{0})
+			continue
+		}
+		linkName, err := link.TransformToNameInfo(snap.geoInfo, snap.idcInfo.IdcId2Name)
+		// the city and area names are not in the dictionaries but given by
+		// the covers
+		if err == nil && link.CityId != 0 {
+			if linkName.CityName = snap.linkIdData[link].CityName; linkName.CityName == "" {
+				err = &linkdb.NameNotFoundError{Dimension: "city", Id: link.CityId}
+			}
+		}
+		if err == nil && link.AreaId != 0 {
+			if linkName.AreaName = snap.linkIdData[link].AreaName; linkName.AreaName == "" {
+				err = &linkdb.NameNotFoundError{Dimension: "area", Id: link.AreaId}
+			}
+		}
+		if err != nil {
+			if notFound, ok := err.(*linkdb.NameNotFoundError); ok {
+				snap.untranslatedLinks = append(snap.untranslatedLinks, untranslatedLink{
+					NationId:   link.NationId,
+					ProvinceId: link.ProvinceId,
+					CityId:     link.CityId,
+					AreaId:     link.AreaId,
+					IspId:      link.IspId,
+					IdcId:      link.IdcId,
+					Missing:    notFound.Dimension,
+				})
+			}
+			h.Write([]byte{0})
+			continue
+		}
+		snap.linkNameData = append(snap.linkNameData, linkName)
+		snap.linkNameIds = append(snap.linkNameIds, link)
+		h.Write([]byte{1})
+		for _, name := range []string{linkName.NationName, linkName.ProvinceName, linkName.CityName, linkName.AreaName, linkName.IspName, linkName.IdcName} {
+			hashString(h, name)
+		}
+	}
+	snap.versionId = hashVersion(h.Sum(nil))
+}
+
+// hash what is served of a link besides its names, the ips and the sources
+// are hashed in the order of their encodings, so the order they were found
+// in does not matter. The oss of a source is left out, the replicas and a
+// cluster after a failover ask other osses for the same covers.
+func hashDetail(h hash.Hash, detail *dnslink.LinkDetail) {
+	var buf [16]byte
+	binary.BigEndian.PutUint64(buf[0:], uint64(detail.Priority))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(detail.Weight))
+	h.Write(buf[:])
+	ips := make([]string, 0, len(detail.Ips))
+	for _, ip := range detail.Ips {
+		ips = append(ips, fmt.Sprintf("%q %q %d %t", ip.Ip, ip.Vip, ip.Type, ip.Inner))
+	}
+	hashStrings(h, ips)
+	sources := make([]string, 0, len(detail.Sources))
+	for _, s := range detail.Sources {
+		sources = append(sources, fmt.Sprintf("%d %d %q %d %d %t %d %v %t %q",
+			s.ResId, s.ResGroupId, s.ResGroupName, s.ResGroupType,
+			s.AreaId, s.AreaExpanded, s.Priority, s.Weight, s.WeightError, s.BadWeight))
+	}
+	hashStrings(h, sources)
+}
+
+// sort the strings and hash them with their count
+func hashStrings(h hash.Hash, strings []string) {
+	sort.Strings(strings)
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(strings)))
+	h.Write(buf[:])
+	for _, s := range strings {
+		hashString(h, s)
+	}
+}
+
+// write the length before the string, so the boundaries are hashed too
+func hashString(h hash.Hash, s string) {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(len(s)))
+	h.Write(buf[:])
+	h.Write([]byte(s))
+}
+
+// the version is positive, 0 is left to the clients which have no links yet.
+// It is kept to 53 bits, so the clients reading json numbers as doubles get
+// it exactly.
+func hashVersion(sum []byte) int64 {
+	version := int64(binary.BigEndian.Uint64(sum) & (1<<53 - 1))
+	if version == 0 {
+		version = 1
+	}
+	return version
+}
+
+func sortLinks(links dnslink.Links) []linkdb.DnsCoverLinkIdInfo {
+	sortedLinks := make([]linkdb.DnsCoverLinkIdInfo, 0, len(links))
+	for link := range links {
+		sortedLinks = append(sortedLinks, link)
+	}
+	sort.Slice(sortedLinks, func(i, j int) bool {
+		a, b := sortedLinks[i], sortedLinks[j]
+		if a.NationId != b.NationId {
+			return a.NationId < b.NationId
+		}
+		if a.ProvinceId != b.ProvinceId {
+			return a.ProvinceId < b.ProvinceId
+		}
+		if a.CityId != b.CityId {
+			return a.CityId < b.CityId
+		}
+		if a.AreaId != b.AreaId {
+			return a.AreaId < b.AreaId
+		}
+		if a.IspId != b.IspId {
+			return a.IspId < b.IspId
+		}
+		return a.IdcId < b.IdcId
+	})
+	return sortedLinks
+}
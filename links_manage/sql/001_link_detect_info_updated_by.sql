@@ -0,0 +1,4 @@
+-- who set the exception mask of a link: the identity of the client
+-- certificate of post_detect_links_change, or its ip without mtls
+ALTER TABLE link_detect_info
+	ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '' AFTER exception_mask;
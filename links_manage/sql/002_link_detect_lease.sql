@@ -0,0 +1,7 @@
+-- the leases of the leader election among the replicas, needed when
+-- [leader] enabled=true
+CREATE TABLE IF NOT EXISTS link_detect_lease (
+	name        VARCHAR(64) NOT NULL PRIMARY KEY,
+	holder      VARCHAR(255) NOT NULL,
+	expire_time DATETIME NOT NULL
+);
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"io/ioutil"
+)
+
+// TLSConfig of the listener, plain http is served when CertFile is empty
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	// client certificates are required and verified against the bundle when
+	// not empty
+	ClientCAFile string
+}
+
+const clientIdentityKey = "client_identity"
+
+func (conf *TLSConfig) Enabled() bool {
+	return conf.CertFile != ""
+}
+
+func (conf *TLSConfig) validate() error {
+	if (conf.CertFile == "") != (conf.KeyFile == "") {
+		return fmt.Errorf("certFile and keyFile must be set together")
+	}
+	if conf.ClientCAFile != "" && conf.CertFile == "" {
+		return fmt.Errorf("clientCAFile needs certFile and keyFile")
+	}
+	return nil
+}
+
+func (conf *TLSConfig) serverTLSConfig() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load key pair failed: %s", err.Error())
+	}
+	tlsConf := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if conf.ClientCAFile != "" {
+		caPem, err := ioutil.ReadFile(conf.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("read client ca failed: %s", err.Error())
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caPem) {
+			return nil, fmt.Errorf("no certificate in client ca %s", conf.ClientCAFile)
+		}
+		tlsConf.ClientCAs = pool
+		tlsConf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConf, nil
+}
+
+// put the identity of the verified client certificate into the context, the
+// common name is used, or the first dns name, email or uri when it is empty
+func clientIdentityMiddleware(c *gin.Context) {
+	if c.Request.TLS != nil && len(c.Request.TLS.VerifiedChains) > 0 && len(c.Request.TLS.VerifiedChains[0]) > 0 {
+		cert := c.Request.TLS.VerifiedChains[0][0]
+		identity := cert.Subject.CommonName
+		if identity == "" && len(cert.DNSNames) > 0 {
+			identity = cert.DNSNames[0]
+		}
+		if identity == "" && len(cert.EmailAddresses) > 0 {
+			identity = cert.EmailAddresses[0]
+		}
+		if identity == "" && len(cert.URIs) > 0 {
+			identity = cert.URIs[0].String()
+		}
+		c.Set(clientIdentityKey, identity)
+	}
+	c.Next()
+}
+
+// identity of the verified client certificate, empty without mtls
+func clientIdentity(c *gin.Context) string {
+	return c.GetString(clientIdentityKey)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	der  []byte
+}
+
+// issue a certificate signed by parent, self signed when parent is nil
+func issueTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	signerCert, signerKey := template, key
+	if parent != nil {
+		signerCert, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signerCert, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCert{cert: cert, key: key, der: der}
+}
+
+func writePem(t *testing.T, path, blockType string, der []byte) {
+	t.Helper()
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	dir, err := ioutil.TempDir("", "tls_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ca := issueTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "test ca"},
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}, nil)
+	server := issueTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(2), Subject: pkix.Name{CommonName: "links server"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")}, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}}, ca)
+	client := issueTestCert(t, &x509.Certificate{SerialNumber: big.NewInt(3), Subject: pkix.Name{CommonName: "detector-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}}, ca)
+
+	conf := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.pem"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.pem"),
+	}
+	writePem(t, conf.CertFile, "CERTIFICATE", server.der)
+	serverKey, err := x509.MarshalECPrivateKey(server.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writePem(t, conf.KeyFile, "EC PRIVATE KEY", serverKey)
+	writePem(t, conf.ClientCAFile, "CERTIFICATE", ca.der)
+	tlsConf, err := conf.serverTLSConfig()
+	if err != nil {
+		t.Fatalf("load tls config failed: %v", err)
+	}
+
+	router := (&Server{}).Router()
+	router.GET("/identity", func(c *gin.Context) {
+		c.String(http.StatusOK, clientIdentity(c))
+	})
+	httpServer := httptest.NewUnstartedServer(router)
+	httpServer.TLS = tlsConf
+	httpServer.StartTLS()
+	defer httpServer.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	clientTLS := &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{{Certificate: [][]byte{client.der}, PrivateKey: client.key}}}
+	resp, err := (&http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}).Get(httpServer.URL + "/identity")
+	if err != nil {
+		t.Fatalf("request with client certificate failed: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "detector-1" {
+		t.Errorf("got identity %q, want detector-1", body)
+	}
+
+	clientTLS.Certificates = nil
+	if _, err = (&http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}).Get(httpServer.URL + "/identity"); err == nil {
+		t.Error("request without client certificate should fail")
+	}
+}
+
+func TestTLSConfigValidate(t *testing.T) {
+	for _, conf := range []TLSConfig{
+		{CertFile: "server.pem"},
+		{KeyFile: "server.key"},
+		{ClientCAFile: "ca.pem"},
+	} {
+		if err := conf.validate(); err == nil {
+			t.Errorf("validate %+v should fail", conf)
+		}
+	}
+	if err := (&TLSConfig{}).validate(); err != nil {
+		t.Errorf("plain http config is invalid: %v", err)
+	}
+}
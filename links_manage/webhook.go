@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/go-ini/ini"
+	"github.com/golang/glog"
+	"links_manage/db_operation"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// the events sent to the webhooks
+const (
+	// the version of the links changed by a link refresh
+	eventLinksChanged = "links_changed"
+	// exception masks are written by post_detect_links_change
+	eventMasksUpdated = "masks_updated"
+)
+
+// WebhookSubscriber is a [webhook.<name>] section of the config
+type WebhookSubscriber struct {
+	Name string
+	Url  string
+	// the events sent, all of them when empty
+	Events []string
+	// key of the hmac-sha256 signature of the body, the body is not signed
+	// when empty
+	Secret string
+}
+
+func (sub *WebhookSubscriber) wants(event string) bool {
+	if len(sub.Events) == 0 {
+		return true
+	}
+	for _, wanted := range sub.Events {
+		if wanted == event {
+			return true
+		}
+	}
+	return false
+}
+
+// WebhookConfig of the events sent to the subscribers, in the [webhooks]
+// section and the [webhook.<name>] sections
+type WebhookConfig struct {
+	Subscribers []WebhookSubscriber
+	Timeout     time.Duration
+	// attempts after the first one, the delay doubles from InitialBackoff
+	Retries        int
+	InitialBackoff time.Duration
+	// number of deliveries kept in the log
+	LogSize int
+}
+
+func loadWebhookConfig(cfg *ini.File) (WebhookConfig, error) {
+	section := cfg.Section("webhooks")
+	conf := WebhookConfig{
+		Timeout:        time.Second * time.Duration(section.Key("timeout").MustInt(5)),
+		Retries:        section.Key("retries").MustInt(3),
+		InitialBackoff: time.Millisecond * time.Duration(section.Key("initialBackoffMs").MustInt(500)),
+		LogSize:        section.Key("logSize").MustInt(100),
+	}
+	if conf.Retries < 0 || conf.LogSize <= 0 {
+		return conf, fmt.Errorf("retries must not be negative and logSize must be positive")
+	}
+	for _, sub := range cfg.Sections() {
+		if !strings.HasPrefix(sub.Name(), "webhook.") {
+			continue
+		}
+		subscriber := WebhookSubscriber{
+			Name:   strings.TrimPrefix(sub.Name(), "webhook."),
+			Url:    sub.Key("url").String(),
+			Events: sub.Key("events").Strings(","),
+			Secret: sub.Key("secret").String(),
+		}
+		if !strings.HasPrefix(subscriber.Url, "http://") && !strings.HasPrefix(subscriber.Url, "https://") {
+			return conf, fmt.Errorf("url %q of webhook %s is not a http url", subscriber.Url, subscriber.Name)
+		}
+		for _, event := range subscriber.Events {
+			if event != eventLinksChanged && event != eventMasksUpdated {
+				return conf, fmt.Errorf("unknown event %s of webhook %s", event, subscriber.Name)
+			}
+		}
+		conf.Subscribers = append(conf.Subscribers, subscriber)
+	}
+	return conf, nil
+}
+
+// webhookEvent is the body posted to the subscribers
+type webhookEvent struct {
+	// the same for all the subscribers and attempts, for the receivers to
+	// dedupe
+	Id    string      `json:"id"`
+	Event string      `json:"event"`
+	Time  time.Time   `json:"time"`
+	Data  interface{} `json:"data"`
+}
+
+type linksChangedData struct {
+	VersionId         int64 `json:"version_id"`
+	PreviousVersionId int64 `json:"previous_version_id"`
+	LinkCount         int   `json:"link_count"`
+}
+
+type masksUpdatedData struct {
+	Operator string            `json:"operator"`
+	RowCount int64             `json:"row_count"`
+	Links    []linkdb.PostLink `json:"links"`
+}
+
+// webhookDelivery is an event sent to a subscriber, in the delivery log
+type webhookDelivery struct {
+	EventId    string    `json:"event_id"`
+	Event      string    `json:"event"`
+	Subscriber string    `json:"subscriber"`
+	Attempts   int       `json:"attempts"`
+	Delivered  bool      `json:"delivered"`
+	HttpStatus int       `json:"http_status,omitempty"`
+	Error      string    `json:"error,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+type webhookJob struct {
+	subscriber *WebhookSubscriber
+	event      string
+	eventId    string
+	body       []byte
+}
+
+// the events waiting for a subscriber, delivered by a worker of its own
+type webhookQueue struct {
+	subscriber *WebhookSubscriber
+	jobs       chan webhookJob
+}
+
+// webhookDispatcher delivers the events in the background, every subscriber
+// gets them in the order of the events, a subscriber down or slow does not
+// hold up the others
+type webhookDispatcher struct {
+	conf   *WebhookConfig
+	client *http.Client
+	queues []webhookQueue
+
+	mu sync.Mutex
+	// ring of the last deliveries, next is the index of the oldest one
+	deliveries []webhookDelivery
+	next       int
+}
+
+func newWebhookDispatcher(conf *WebhookConfig) *webhookDispatcher {
+	d := &webhookDispatcher{
+		conf:   conf,
+		client: &http.Client{Timeout: conf.Timeout},
+	}
+	for i := range conf.Subscribers {
+		d.queues = append(d.queues, webhookQueue{subscriber: &conf.Subscribers[i], jobs: make(chan webhookJob, 1000)})
+	}
+	return d
+}
+
+// emit queues the event for the subscribers wanting it, the event is dropped
+// for a subscriber whose queue is full
+func (d *webhookDispatcher) emit(event string, data interface{}) {
+	e := webhookEvent{Id: newEventId(), Event: event, Time: time.Now(), Data: data}
+	body, err := json.Marshal(&e)
+	if err != nil {
+		glog.Errorf("encode event %s failed: %s", event, err.Error())
+		return
+	}
+	for _, queue := range d.queues {
+		subscriber := queue.subscriber
+		if !subscriber.wants(event) {
+			continue
+		}
+		select {
+		case queue.jobs <- webhookJob{subscriber: subscriber, event: event, eventId: e.Id, body: body}:
+		default:
+			glog.Errorf("webhook queue of %s is full, drop event %s %s", subscriber.Name, event, e.Id)
+		}
+	}
+}
+
+func newEventId() string {
+	var buf [16]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return fmt.Sprintf("%d", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(buf[:])
+}
+
+// run delivers the events with a worker per subscriber until ctx is done
+func (d *webhookDispatcher) run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, queue := range d.queues {
+		wg.Add(1)
+		go func(jobs <-chan webhookJob) {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case job := <-jobs:
+					d.log(d.deliver(ctx, &job))
+				}
+			}
+		}(queue.jobs)
+	}
+	wg.Wait()
+}
+
+// hex hmac-sha256 of body, sent as "X-Webhook-Signature: sha256=<hex>"
+func signBody(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// post the job until it is accepted, the retries are given up once ctx is done
+func (d *webhookDispatcher) deliver(ctx context.Context, job *webhookJob) webhookDelivery {
+	delivery := webhookDelivery{EventId: job.eventId, Event: job.event, Subscriber: job.subscriber.Name}
+	backoff := d.conf.InitialBackoff
+	for {
+		delivery.Attempts++
+		delivery.HttpStatus, delivery.Error = 0, ""
+		err := d.post(ctx, job, &delivery)
+		if err == nil {
+			delivery.Delivered = true
+			break
+		}
+		delivery.Error = err.Error()
+		if delivery.Attempts > d.conf.Retries {
+			glog.Errorf("deliver event %s %s to %s failed after %d attempts: %s", job.event, job.eventId, job.subscriber.Name, delivery.Attempts, delivery.Error)
+			break
+		}
+		select {
+		case <-ctx.Done():
+			delivery.Error = ctx.Err().Error()
+			delivery.Time = time.Now()
+			return delivery
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+	delivery.Time = time.Now()
+	return delivery
+}
+
+func (d *webhookDispatcher) post(ctx context.Context, job *webhookJob, delivery *webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, job.subscriber.Url, bytes.NewReader(job.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", job.event)
+	req.Header.Set("X-Webhook-Id", job.eventId)
+	if job.subscriber.Secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+signBody(job.subscriber.Secret, job.body))
+	}
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	delivery.HttpStatus = resp.StatusCode
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("http status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (d *webhookDispatcher) log(delivery webhookDelivery) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if len(d.deliveries) < d.conf.LogSize {
+		d.deliveries = append(d.deliveries, delivery)
+		return
+	}
+	d.deliveries[d.next] = delivery
+	d.next = (d.next + 1) % len(d.deliveries)
+}
+
+// the deliveries in the log, the latest first
+func (d *webhookDispatcher) deliveryLog() []webhookDelivery {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	result := make([]webhookDelivery, 0, len(d.deliveries))
+	for i := len(d.deliveries) - 1; i >= 0; i-- {
+		result = append(result, d.deliveries[(d.next+i)%len(d.deliveries)])
+	}
+	return result
+}
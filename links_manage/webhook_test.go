@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"links_manage/db_operation"
+	"links_manage/dnslink/osstest"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/gin-gonic/gin"
+	"github.com/go-ini/ini"
+)
+
+// webhookEvent as received, with the data left to decode
+type receivedEvent struct {
+	Id    string          `json:"id"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// receiver of the webhooks, failing the first requests
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	failures int
+	events   []receivedEvent
+}
+
+func newWebhookReceiver(t *testing.T, secret string, failures int) *webhookReceiver {
+	r := &webhookReceiver{failures: failures}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			t.Errorf("read webhook failed: %v", err)
+		}
+		if secret != "" && req.Header.Get("X-Webhook-Signature") != "sha256="+signBody(secret, body) {
+			t.Errorf("bad signature %s", req.Header.Get("X-Webhook-Signature"))
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.failures > 0 {
+			r.failures--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var event receivedEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			t.Errorf("decode webhook %s failed: %v", body, err)
+		}
+		if req.Header.Get("X-Webhook-Event") != event.Event || req.Header.Get("X-Webhook-Id") != event.Id {
+			t.Errorf("headers %v do not match event %+v", req.Header, event)
+		}
+		r.events = append(r.events, event)
+	}))
+	t.Cleanup(r.Close)
+	return r
+}
+
+// wait for n events received
+func (r *webhookReceiver) wait(t *testing.T, n int) []receivedEvent {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r.mu.Lock()
+		events := append([]receivedEvent(nil), r.events...)
+		r.mu.Unlock()
+		if len(events) >= n {
+			return events
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("got %d events, want %d", len(events), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWebhookDispatcher(t *testing.T) {
+	retried := newWebhookReceiver(t, "s3cret", 2)
+	filtered := newWebhookReceiver(t, "", 0)
+	d := newWebhookDispatcher(&WebhookConfig{
+		Subscribers: []WebhookSubscriber{
+			{Name: "retried", Url: retried.URL, Secret: "s3cret"},
+			{Name: "filtered", Url: filtered.URL, Events: []string{eventMasksUpdated}},
+		},
+		Timeout:        time.Second,
+		Retries:        2,
+		InitialBackoff: time.Millisecond,
+		LogSize:        10,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go d.run(ctx)
+
+	d.emit(eventLinksChanged, &linksChangedData{VersionId: 2, PreviousVersionId: 1, LinkCount: 5})
+	d.emit(eventMasksUpdated, &masksUpdatedData{Operator: "tester", RowCount: 1})
+	events := retried.wait(t, 2)
+	if events[0].Event != eventLinksChanged || events[1].Event != eventMasksUpdated {
+		t.Errorf("unexpected events %+v", events)
+	}
+	if events := filtered.wait(t, 1); len(events) != 1 || events[0].Event != eventMasksUpdated {
+		t.Errorf("unexpected filtered events %+v", events)
+	}
+
+	// the subscribers are delivered in parallel, the log is in the order the
+	// deliveries end
+	deadline := time.Now().Add(5 * time.Second)
+	for len(d.deliveryLog()) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("unexpected delivery log %+v", d.deliveryLog())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	attempts := make(map[string]int)
+	for _, delivery := range d.deliveryLog() {
+		if !delivery.Delivered {
+			t.Errorf("unexpected delivery %+v", delivery)
+		}
+		attempts[delivery.Subscriber+" "+delivery.Event] = delivery.Attempts
+	}
+	want := map[string]int{"retried " + eventLinksChanged: 3, "retried " + eventMasksUpdated: 1, "filtered " + eventMasksUpdated: 1}
+	if !reflect.DeepEqual(attempts, want) {
+		t.Errorf("got attempts %v, want %v", attempts, want)
+	}
+}
+
+func TestWebhookSubscribersAreIndependent(t *testing.T) {
+	// the stuck subscriber answers nothing until the request is canceled
+	stuck := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		// the cancel is only seen once the body is read
+		ioutil.ReadAll(req.Body)
+		<-req.Context().Done()
+	}))
+	defer stuck.Close()
+	receiver := newWebhookReceiver(t, "", 0)
+	d := newWebhookDispatcher(&WebhookConfig{
+		Subscribers: []WebhookSubscriber{
+			{Name: "stuck", Url: stuck.URL},
+			{Name: "receiver", Url: receiver.URL},
+		},
+		Timeout:        time.Minute,
+		InitialBackoff: time.Millisecond,
+		LogSize:        10,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.run(ctx)
+		close(done)
+	}()
+
+	d.emit(eventLinksChanged, &linksChangedData{VersionId: 2})
+	d.emit(eventLinksChanged, &linksChangedData{VersionId: 3})
+	receiver.wait(t, 2)
+
+	// the workers stop with the delivery in flight
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("the dispatcher does not stop")
+	}
+}
+
+func TestWebhookDeliveryLog(t *testing.T) {
+	d := newWebhookDispatcher(&WebhookConfig{LogSize: 2})
+	for _, id := range []string{"1", "2", "3"} {
+		d.log(webhookDelivery{EventId: id})
+	}
+	// the last 2 deliveries, the latest first
+	deliveries := d.deliveryLog()
+	if len(deliveries) != 2 || deliveries[0].EventId != "3" || deliveries[1].EventId != "2" {
+		t.Errorf("unexpected delivery log %+v", deliveries)
+	}
+}
+
+func TestWebhookGiveUp(t *testing.T) {
+	receiver := newWebhookReceiver(t, "", 10)
+	d := newWebhookDispatcher(&WebhookConfig{
+		Subscribers:    []WebhookSubscriber{{Name: "down", Url: receiver.URL}},
+		Timeout:        time.Second,
+		Retries:        1,
+		InitialBackoff: time.Millisecond,
+		LogSize:        10,
+	})
+	d.emit(eventLinksChanged, &linksChangedData{VersionId: 2})
+	job := <-d.queues[0].jobs
+	delivery := d.deliver(context.Background(), &job)
+	if delivery.Delivered || delivery.Attempts != 2 || delivery.HttpStatus != http.StatusServiceUnavailable {
+		t.Errorf("unexpected delivery %+v", delivery)
+	}
+}
+
+func TestLoadWebhookConfig(t *testing.T) {
+	cfg, err := ini.Load([]byte("[webhooks]\nretries=1\n[webhook.scheduler]\nurl=http://127.0.0.1/hook\nevents=links_changed\nsecret=x\n"))
+	if err != nil {
+		t.Fatalf("load ini failed: %v", err)
+	}
+	conf, err := loadWebhookConfig(cfg)
+	if err != nil {
+		t.Fatalf("load webhook config failed: %v", err)
+	}
+	if conf.Retries != 1 || len(conf.Subscribers) != 1 || conf.Subscribers[0].Name != "scheduler" || conf.Subscribers[0].Secret != "x" {
+		t.Errorf("unexpected config %+v", conf)
+	}
+
+	for _, content := range []string{
+		"[webhook.scheduler]\nurl=scheduler/hook\n",
+		"[webhook.scheduler]\nurl=http://127.0.0.1/hook\nevents=links_removed\n",
+		"[webhooks]\nretries=-1\n",
+	} {
+		cfg, err := ini.Load([]byte(content))
+		if err != nil {
+			t.Fatalf("load ini failed: %v", err)
+		}
+		if _, err = loadWebhookConfig(cfg); err == nil {
+			t.Errorf("config %q should be invalid", content)
+		}
+	}
+}
+
+func TestServerWebhooks(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	receiver := newWebhookReceiver(t, "", 0)
+	conf := testConfig()
+	conf.Webhooks = WebhookConfig{
+		Subscribers:    []WebhookSubscriber{{Name: "scheduler", Url: receiver.URL}},
+		Timeout:        time.Second,
+		InitialBackoff: time.Millisecond,
+		LogSize:        10,
+	}
+	s, _, mock := startTestServer(t, conf)
+
+	events := receiver.wait(t, 1)
+	var changed linksChangedData
+	if err := json.Unmarshal(events[0].Data, &changed); err != nil {
+		t.Fatalf("decode event data %s failed: %v", events[0].Data, err)
+	}
+	if events[0].Event != eventLinksChanged || changed.VersionId != s.snapshot().versionId || changed.LinkCount != 5 {
+		t.Errorf("unexpected event %+v", events[0])
+	}
+
+	mock.ExpectExec(updateLinkMaskSql).
+		WithArgs(156, 11, 1, 1001, 1, "192.0.2.1").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	body := `[{"nation": "china", "province": "beijing", "isp": "telecom", "idc_name": "bj-idc-1", "exception_mask": 1}]`
+	req := httptest.NewRequest(http.MethodPost, "/post_detect_links_change", bytes.NewBufferString(body))
+	if resp := doRequest(t, s.Router(), req); resp.Errno != 0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	events = receiver.wait(t, 2)
+	var updated masksUpdatedData
+	if err := json.Unmarshal(events[1].Data, &updated); err != nil {
+		t.Fatalf("decode event data %s failed: %v", events[1].Data, err)
+	}
+	if events[1].Event != eventMasksUpdated || updated.RowCount != 1 || len(updated.Links) != 1 || updated.Links[0].ProvinceName != "beijing" {
+		t.Errorf("unexpected event %+v", events[1])
+	}
+}
+
+func TestServerWebhooksOnDictChange(t *testing.T) {
+	receiver := newWebhookReceiver(t, "", 0)
+	conf := testConfig()
+	conf.Webhooks = WebhookConfig{
+		Subscribers:    []WebhookSubscriber{{Name: "scheduler", Url: receiver.URL}},
+		Timeout:        time.Second,
+		InitialBackoff: time.Millisecond,
+		LogSize:        10,
+	}
+	oss := osstest.NewDefaultServer()
+	defer oss.Close()
+	// gz-idc-1 is not known yet, 2 of the 5 links have no name
+	oss.SetFixture("idc_query.json", `{"errno": 0, "error": "", "seq": 1, "data": [{"id": 1001, "idcName": "bj-idc-1"}]}`)
+	s, _ := startTestServerOn(t, conf, oss)
+	receiver.wait(t, 1)
+	oldVersionId := s.versionId()
+
+	// only the dictionary changes, the links get their names
+	oss.SetFixture("idc_query.json", `{"errno": 0, "error": "", "seq": 1, "data": [
+		{"id": 1001, "idcName": "bj-idc-1"}, {"id": 1002, "idcName": "gz-idc-1"}]}`)
+	if err := s.updateIdcInfo([]linkdb.OssDb{{Master: oss.Addr, Slaver: oss.Addr}}); err != nil {
+		t.Fatalf("update idc info failed: %v", err)
+	}
+	events := receiver.wait(t, 2)
+	var changed linksChangedData
+	if err := json.Unmarshal(events[1].Data, &changed); err != nil {
+		t.Fatalf("decode event data %s failed: %v", events[1].Data, err)
+	}
+	if events[1].Event != eventLinksChanged || changed.PreviousVersionId != oldVersionId || changed.VersionId != s.versionId() || changed.LinkCount != 5 {
+		t.Errorf("unexpected event %+v %+v", events[1], changed)
+	}
+}